@@ -16,13 +16,27 @@ func main() {
 	switch os.Args[1] {
 	case "_server":
 		var cmd []string
+		var opts server.Options
 		for i := 2; i < len(os.Args); i++ {
 			if os.Args[i] == "--" {
 				cmd = os.Args[i+1:]
 				break
 			}
+			if os.Args[i] == "--output-log" && i+1 < len(os.Args) {
+				opts.OutputLog = os.Args[i+1]
+				i++
+			} else if os.Args[i] == "--theme" && i+1 < len(os.Args) {
+				opts.Theme = os.Args[i+1]
+				i++
+			} else if os.Args[i] == "--emulator" && i+1 < len(os.Args) {
+				opts.Emulator = os.Args[i+1]
+				i++
+			} else if os.Args[i] == "--identity" && i+1 < len(os.Args) {
+				opts.Identity = os.Args[i+1]
+				i++
+			}
 		}
-		if err := server.Start(cmd); err != nil {
+		if err := server.Start(cmd, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
 			os.Exit(1)
 		}
@@ -30,12 +44,48 @@ func main() {
 		client.Spawn(os.Args[2:])
 	case "type":
 		client.Type(os.Args[2:])
+	case "paste":
+		client.Paste(os.Args[2:])
+	case "mouse":
+		client.Mouse(os.Args[2:])
+	case "find":
+		client.Find(os.Args[2:])
+	case "click":
+		client.Click(os.Args[2:])
+	case "expect":
+		client.Expect(os.Args[2:])
 	case "capture":
 		client.Capture(os.Args[2:])
 	case "history":
-		client.History()
+		client.History(os.Args[2:])
+	case "replay":
+		client.Replay(os.Args[2:])
+	case "output":
+		client.Output(os.Args[2:])
+	case "resize":
+		client.Resize(os.Args[2:])
+	case "signal":
+		client.Signal(os.Args[2:])
 	case "wait":
-		client.Wait()
+		client.Wait(os.Args[2:])
+	case "wait-stable":
+		client.WaitStable(os.Args[2:])
+	case "wait-for":
+		client.WaitFor(os.Args[2:])
+	case "status":
+		client.Status(os.Args[2:])
+	case "title":
+		client.Title(os.Args[2:])
+	case "events":
+		client.Events(os.Args[2:])
+	case "clipboard":
+		client.Clipboard(os.Args[2:])
+	case "links":
+		client.Links()
+	case "modes":
+		client.Modes(os.Args[2:])
+	case "batch":
+		client.Batch(os.Args[2:])
 	case "kill":
 		client.Kill()
 	case "quickstart":
@@ -49,11 +99,29 @@ func main() {
 func printUsage() {
 	fmt.Println("Usage: specter <command> [args]")
 	fmt.Println("Commands:")
-	fmt.Println("  spawn       Start a new session (usage: specter spawn [-- <cmd>])")
-	fmt.Println("  type        Send input to session (usage: specter type <text>)")
-	fmt.Println("  capture     Capture screen content (usage: specter capture [--format png] [--out file])")
-	fmt.Println("  history     Show input history")
-	fmt.Println("  wait        Wait for process to exit and return exit code")
+	fmt.Println("  spawn       Start a new session (usage: specter spawn [--output-log file] [--theme name|file] [--emulator libvterm|go] [--identity xterm|kitty|tmux] [-- <cmd>])")
+	fmt.Println("  type        Send input to session (usage: specter type <text...|--file F|->... [--raw] [--delay 30ms] [--jitter 10ms] [--per-char])")
+	fmt.Println("  paste       Paste text, bracketed if the app enabled it (usage: specter paste <text|--file F|->)")
+	fmt.Println("  mouse       Send mouse input (usage: specter mouse click|down|up|move|drag|scroll <row> <col> [--button B] [--mods C,M,S])")
+	fmt.Println("  find        Locate text on screen as JSON spans (usage: specter find <text> [--regex] [--ignore-case])")
+	fmt.Println("  click       Click the nth match of text (usage: specter click <text> [--nth N] [--button B])")
+	fmt.Println("  expect      Answer prompts automatically (usage: specter expect [--on <re> --send <text>]... [--until <re> [--until-screen]] [--timeout 30s])")
+	fmt.Println("  capture     Capture screen content (usage: specter capture [--format text|json|png|html|svg] [--region R] [--trim] [--squeeze] [--numbered] [--wrap-join] [--font path]... [--font-size pt] [--scale 2x] [--padding px] [--title-bar] [--out file])")
+	fmt.Println("  output      Show raw PTY output with timestamps (usage: specter output [--strip-ansi|--raw|--json])")
+	fmt.Println("  history     Show input history (usage: specter history [--json])")
+	fmt.Println("  replay      Replay a history file into a fresh session (usage: specter replay <history.json> [--speed 2x])")
+	fmt.Println("  resize      Resize the terminal (usage: specter resize <rows> <cols>)")
+	fmt.Println("  signal      Send a signal to the process (usage: specter signal <INT|TERM|...>)")
+	fmt.Println("  wait        Wait for process to exit and return exit code (usage: specter wait [--timeout 10s])")
+	fmt.Println("  wait-stable Wait until output settles (usage: specter wait-stable [--quiet 300ms] [--timeout 10s])")
+	fmt.Println("  wait-for    Wait until terminal state matches (usage: specter wait-for [--title <regex>] [--bell] [--mode name=value]... [--timeout 10s])")
+	fmt.Println("  status      Show the session's command, state, size, title and event counts (usage: specter status [--json])")
+	fmt.Println("  title       Show the window title set with OSC 0/2 (usage: specter title [--icon] [--json])")
+	fmt.Println("  events      Show bells and desktop notifications (OSC 9/777) (usage: specter events [--json])")
+	fmt.Println("  clipboard   Read or set the OSC 52 clipboard (usage: specter clipboard get|set <text|--file F|-> [--selection c|p|s|0-7])")
+	fmt.Println("  links       List OSC 8 hyperlinks on screen as JSON (usage: specter links)")
+	fmt.Println("  modes       Show terminal modes: alt screen, cursor keys, keypad, mouse, paste, focus (usage: specter modes [--json])")
+	fmt.Println("  batch       Run JSON-lines steps from stdin atomically (usage: specter batch [--continue] < steps.jsonl)")
 	fmt.Println("  kill        Terminate the specter session")
 	fmt.Println("  quickstart  Show quickstart guide for LLM coding agents")
 }
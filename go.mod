@@ -5,10 +5,8 @@ go 1.25.4
 require (
 	github.com/creack/pty v1.1.24
 	github.com/mattn/go-libvterm v0.0.0-20220218002314-74b0d3133396
+	golang.org/x/image v0.33.0
+	golang.org/x/text v0.31.0
 )
 
-require (
-	github.com/mattn/go-pointer v0.0.1 // indirect
-	golang.org/x/image v0.33.0 // indirect
-	golang.org/x/text v0.31.0 // indirect
-)
+require github.com/mattn/go-pointer v0.0.1 // indirect
@@ -0,0 +1,56 @@
+// Package ansi provides helpers for working with raw terminal output.
+package ansi
+
+const esc = 0x1b
+
+// Strip removes escape sequences (CSI, OSC, DCS and other string
+// sequences, and two-byte escapes) and control characters other than
+// newline and tab from terminal output, leaving the printable text.
+func Strip(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+
+		if c != esc {
+			if c >= 0x20 && c != 0x7f || c == '\n' || c == '\t' {
+				out = append(out, c)
+			}
+			continue
+		}
+
+		if i+1 >= len(b) {
+			break
+		}
+
+		switch b[i+1] {
+		case '[':
+			// CSI: parameters and intermediates up to a final byte.
+			i += 2
+			for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+				i++
+			}
+		case ']', 'P', '_', '^', 'X':
+			// String sequences end with BEL or ST (ESC \).
+			i += 2
+			for i < len(b) {
+				if b[i] == 0x07 {
+					break
+				}
+				if b[i] == esc && i+1 < len(b) && b[i+1] == '\\' {
+					i++
+					break
+				}
+				i++
+			}
+		default:
+			// Two-byte escape, possibly with intermediates (e.g. ESC ( B).
+			i++
+			for i < len(b) && b[i] >= 0x20 && b[i] <= 0x2f {
+				i++
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,235 @@
+package ansi
+
+// CSI is a control sequence such as ESC [ ? 2004 h.
+type CSI struct {
+	// Private is the parameter prefix ('?', '>', '<' or '='), or 0.
+	Private byte
+	Params  []int
+
+	// Subparams holds the colon-separated values that follow a parameter,
+	// as in ESC [ 4:3 m or ESC [ 38:2::255:0:0 m, indexed like Params. It
+	// is shorter than Params, or nil, when later parameters have none.
+	Subparams [][]int
+
+	Intermediates []byte
+	Final         byte
+}
+
+// Param returns the i'th parameter, or def if it is missing or zero.
+func (c CSI) Param(i, def int) int {
+	if i < len(c.Params) && c.Params[i] != 0 {
+		return c.Params[i]
+	}
+	return def
+}
+
+// Sub returns the subparameters of the i'th parameter.
+func (c CSI) Sub(i int) []int {
+	if i < len(c.Subparams) {
+		return c.Subparams[i]
+	}
+	return nil
+}
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateCSI
+	stateString
+	stateStringEscape
+)
+
+// maxStringSize bounds OSC/DCS/APC payloads; longer sequences are dropped.
+// It is generous because graphics protocols send whole images this way.
+const maxStringSize = 32 << 20
+
+// Parser splits terminal output into escape sequences, keeping state across
+// Feed calls so sequences split between reads are reported whole. All
+// handlers are optional; slices passed to them are only valid for the
+// duration of the call.
+type Parser struct {
+	// Print receives bytes outside escape sequences that are not C0
+	// controls, including UTF-8 continuation bytes.
+	Print   func(c byte)
+	CSI     func(seq CSI)
+	Escape  func(intermediates []byte, final byte)
+	Control func(c byte)
+
+	// String receives OSC (']'), DCS ('P'), APC ('_'), PM ('^') and SOS
+	// ('X') payloads, without the introducer and terminator.
+	String func(kind byte, data []byte)
+
+	state   parserState
+	csi     CSI
+	param   int
+	inParam bool
+	inSub   bool
+	kind    byte
+	buf     []byte
+	over    bool
+	pos     int
+}
+
+func (p *Parser) Feed(b []byte) {
+	for i, c := range b {
+		p.pos = i
+		p.feed(c)
+	}
+}
+
+// Pos returns the offset of the byte being parsed within the slice passed
+// to Feed. Handlers use it to find where the sequence they receive ends.
+func (p *Parser) Pos() int {
+	return p.pos
+}
+
+func (p *Parser) feed(c byte) {
+	switch p.state {
+	case stateGround:
+		if c == esc {
+			p.state = stateEscape
+			p.buf = p.buf[:0]
+		} else if c < 0x20 || c == 0x7f {
+			if p.Control != nil {
+				p.Control(c)
+			}
+		} else if p.Print != nil {
+			p.Print(c)
+		}
+
+	case stateEscape:
+		switch {
+		case c == '[':
+			p.state = stateCSI
+			p.csi = CSI{}
+			p.param = 0
+			p.inParam = false
+			p.inSub = false
+		case c == ']' || c == 'P' || c == '_' || c == '^' || c == 'X':
+			p.state = stateString
+			p.kind = c
+			p.buf = p.buf[:0]
+			p.over = false
+		case c >= 0x20 && c <= 0x2f:
+			p.buf = append(p.buf, c)
+		case c == esc:
+			p.buf = p.buf[:0]
+		case c < 0x20:
+			// Controls are executed even inside escape sequences.
+			if p.Control != nil {
+				p.Control(c)
+			}
+		default:
+			if p.Escape != nil {
+				p.Escape(p.buf, c)
+			}
+			p.state = stateGround
+		}
+
+	case stateCSI:
+		switch {
+		case c >= '0' && c <= '9':
+			p.param = p.param*10 + int(c-'0')
+			if p.param > 1<<16 {
+				p.param = 1 << 16
+			}
+			p.inParam = true
+		case c == ';':
+			p.endParam()
+		case c == ':':
+			// Subparameters stay with the parameter they follow.
+			if p.inSub {
+				i := len(p.csi.Params) - 1
+				p.csi.Subparams[i] = append(p.csi.Subparams[i], p.param)
+			} else {
+				p.csi.Params = append(p.csi.Params, p.param)
+				for len(p.csi.Subparams) < len(p.csi.Params) {
+					p.csi.Subparams = append(p.csi.Subparams, nil)
+				}
+				p.csi.Subparams[len(p.csi.Params)-1] = []int{}
+				p.inSub = true
+			}
+			p.param = 0
+			p.inParam = false
+		case c >= '<' && c <= '?':
+			if len(p.csi.Params) == 0 && !p.inParam {
+				p.csi.Private = c
+			}
+		case c >= 0x20 && c <= 0x2f:
+			p.csi.Intermediates = append(p.csi.Intermediates, c)
+		case c >= 0x40 && c <= 0x7e:
+			if p.inParam || p.inSub || len(p.csi.Params) > 0 {
+				p.endParam()
+			}
+			p.csi.Final = c
+			if p.CSI != nil {
+				p.CSI(p.csi)
+			}
+			p.state = stateGround
+		case c == esc:
+			p.state = stateEscape
+			p.buf = p.buf[:0]
+		case c < 0x20:
+			if p.Control != nil {
+				p.Control(c)
+			}
+		}
+
+	case stateString:
+		switch c {
+		case 0x07:
+			if p.kind == ']' {
+				p.finishString()
+				return
+			}
+			p.appendString(c)
+		case esc:
+			p.state = stateStringEscape
+		case 0x18, 0x1a:
+			// CAN and SUB abort the sequence.
+			p.state = stateGround
+		default:
+			p.appendString(c)
+		}
+
+	case stateStringEscape:
+		if c == '\\' {
+			p.finishString()
+			return
+		}
+		// Any other escape aborts the string and starts a new sequence.
+		p.state = stateEscape
+		p.buf = p.buf[:0]
+		p.feed(c)
+	}
+}
+
+func (p *Parser) appendString(c byte) {
+	if len(p.buf) >= maxStringSize {
+		p.over = true
+		return
+	}
+	p.buf = append(p.buf, c)
+}
+
+func (p *Parser) finishString() {
+	p.state = stateGround
+	if !p.over && p.String != nil {
+		p.String(p.kind, p.buf)
+	}
+}
+
+// endParam finishes the parameter or subparameter being parsed.
+func (p *Parser) endParam() {
+	if p.inSub {
+		i := len(p.csi.Params) - 1
+		p.csi.Subparams[i] = append(p.csi.Subparams[i], p.param)
+	} else {
+		p.csi.Params = append(p.csi.Params, p.param)
+	}
+	p.param = 0
+	p.inParam = false
+	p.inSub = false
+}
@@ -1,64 +1,245 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"specter/internal/ansi"
 	"specter/internal/protocol"
 	"specter/internal/server"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func sendRequest(req protocol.Request) (protocol.Response, error) {
+// Conn is a connection to a running specter server that has completed the
+// protocol hello exchange.
+type Conn struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+
+	// framed is set once both sides agree on protocol.FeatureFramed, after
+	// which messages are read from reader as length-prefixed frames.
+	framed bool
+	reader io.Reader
+
+	nextID int
+
+	// Server is the server's hello, holding the negotiated version and the
+	// optional features it supports.
+	Server protocol.Hello
+}
+
+// errUnversioned is returned by Dial for servers predating the hello
+// exchange, which only Kill can still talk to.
+var errUnversioned = errors.New("server speaks an unversioned protocol; run 'specter kill' and spawn again with this binary")
+
+// Dial connects to the server in the current directory and negotiates a
+// protocol version. It fails if the server is too old or too new to talk to.
+func Dial() (*Conn, error) {
 	conn, err := net.Dial("unix", server.SocketName)
 	if err != nil {
-		return protocol.Response{}, err
+		return nil, err
 	}
-	defer conn.Close()
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(req); err != nil {
-		return protocol.Response{}, err
+	c := &Conn{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn),
 	}
 
-	decoder := json.NewDecoder(conn)
-	var resp protocol.Response
-	if err := decoder.Decode(&resp); err != nil {
-		return protocol.Response{}, err
+	resp, _, err := c.roundTrip(protocol.OpHello, protocol.Hello{
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Features:   []string{protocol.FeatureFramed},
+		Client:     fmt.Sprintf("specter/%d", os.Getpid()),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.Status != protocol.StatusOK {
+		conn.Close()
+		if resp.Code == "" {
+			// Servers predating the hello exchange reject it as an unknown op.
+			return nil, errUnversioned
+		}
+		return nil, resp.Err()
+	}
+
+	if err := resp.DecodeResult(&c.Server); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid hello from server: %v", err)
 	}
+	if c.Server.Version < protocol.MinVersion || c.Server.Version > protocol.Version {
+		conn.Close()
+		return nil, fmt.Errorf("server negotiated protocol v%d, client speaks v%d-v%d", c.Server.Version, protocol.MinVersion, protocol.Version)
+	}
+
+	if c.Has(protocol.FeatureFramed) {
+		c.framed = true
+		c.reader = protocol.FrameReader(c.decoder, conn)
+	}
+
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
 
-	return resp, nil
+// Has reports whether the server advertised the optional feature.
+func (c *Conn) Has(feature string) bool {
+	for _, f := range c.Server.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Call sends op with params and decodes the result into result, which may
+// be nil. Any response body is discarded. Error responses are returned as
+// *protocol.Error, after decoding any partial result they carry.
+func (c *Conn) Call(op protocol.Op, params, result interface{}) error {
+	return c.Fetch(op, params, result, nil)
 }
 
-func sendRequestOrExit(req protocol.Request) {
-	resp, err := sendRequest(req)
+// Fetch is like Call but copies the response body to body as it arrives,
+// so large payloads never need to be held in memory on framed connections.
+func (c *Conn) Fetch(op protocol.Op, params, result interface{}, body io.Writer) error {
+	resp, payload, err := c.roundTrip(op, params)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter spawned?\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	if resp.Status != "ok" {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Message)
+	if body == nil {
+		body = io.Discard
+	}
+	if _, err := io.Copy(body, payload); err != nil {
+		return err
+	}
+
+	if result != nil {
+		// Some errors carry a partial result, so decode it either way.
+		if err := resp.DecodeResult(result); err != nil && resp.Status == protocol.StatusOK {
+			return err
+		}
+	}
+	return resp.Err()
+}
+
+// roundTrip sends one request and returns the response header along with a
+// reader over its body, which must be drained before the next request.
+func (c *Conn) roundTrip(op protocol.Op, params interface{}) (protocol.Response, io.Reader, error) {
+	req, err := protocol.NewRequest(op, params)
+	if err != nil {
+		return protocol.Response{}, nil, err
+	}
+	if op != protocol.OpHello {
+		c.nextID++
+		req.ID = strconv.Itoa(c.nextID)
+	}
+
+	var resp protocol.Response
+	var body io.Reader
+
+	if c.framed {
+		if err := protocol.WriteFrame(c.conn, req, nil); err != nil {
+			return protocol.Response{}, nil, err
+		}
+		body, _, err = protocol.ReadFrame(c.reader, &resp)
+		if err != nil {
+			return protocol.Response{}, nil, err
+		}
+	} else {
+		if err := c.encoder.Encode(req); err != nil {
+			return protocol.Response{}, nil, err
+		}
+		if err := c.decoder.Decode(&resp); err != nil {
+			return protocol.Response{}, nil, err
+		}
+		body = bytes.NewReader(resp.Body)
+	}
+
+	if resp.ID != req.ID {
+		return protocol.Response{}, nil, fmt.Errorf("response id %q does not match request id %q", resp.ID, req.ID)
+	}
+
+	return resp, body, nil
+}
+
+// call performs a single request on a fresh connection, exiting the process
+// with a message on any failure.
+func call(op protocol.Op, params, result interface{}) {
+	fetch(op, params, result, nil)
+}
+
+// fetch is call with the response body streamed to body.
+func fetch(op protocol.Op, params, result interface{}, body io.Writer) {
+	c, err := Dial()
+	if err != nil {
+		if _, ok := err.(*protocol.Error); ok {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter spawned?\n", err)
+		}
 		os.Exit(1)
 	}
+	defer c.Close()
 
-	if resp.Data != "" {
-		fmt.Print(resp.Data)
-	} else if resp.Message != "" {
-		fmt.Println(resp.Message)
+	if err := c.Fetch(op, params, result, body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
+		os.Exit(1)
 	}
 }
 
 func Spawn(args []string) {
 	var cmd []string
+	var flags []string
 	for i := 0; i < len(args); i++ {
 		if args[i] == "--" {
 			cmd = args[i+1:]
 			break
 		}
+		if args[i] == "--output-log" && i+1 < len(args) {
+			flags = append(flags, args[i], args[i+1])
+			i++
+		} else if args[i] == "--theme" && i+1 < len(args) {
+			// Check the theme here, where errors reach the user.
+			if _, err := server.LoadTheme(args[i+1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			flags = append(flags, args[i], args[i+1])
+			i++
+		} else if args[i] == "--emulator" && i+1 < len(args) {
+			if names := server.EmulatorNames(); !slices.Contains(names, args[i+1]) {
+				fmt.Fprintf(os.Stderr, "Error: unknown emulator %q (this build has %s)\n", args[i+1], strings.Join(names, ", "))
+				os.Exit(1)
+			}
+			flags = append(flags, args[i], args[i+1])
+			i++
+		} else if args[i] == "--identity" && i+1 < len(args) {
+			if names := server.IdentityNames(); !slices.Contains(names, args[i+1]) {
+				fmt.Fprintf(os.Stderr, "Error: unknown identity %q (available: %s)\n", args[i+1], strings.Join(names, ", "))
+				os.Exit(1)
+			}
+			flags = append(flags, args[i], args[i+1])
+			i++
+		}
 	}
 
 	if len(cmd) == 0 {
@@ -80,7 +261,9 @@ func Spawn(args []string) {
 		os.Exit(1)
 	}
 
-	serverArgs := append([]string{"_server", "--"}, cmd...)
+	serverArgs := append([]string{"_server"}, flags...)
+	serverArgs = append(serverArgs, "--")
+	serverArgs = append(serverArgs, cmd...)
 	serverCmd := exec.Command(exe, serverArgs...)
 	serverCmd.Stdout = os.Stdout
 	serverCmd.Stderr = os.Stderr
@@ -102,19 +285,403 @@ func Spawn(args []string) {
 	os.Exit(1)
 }
 
+// Type sends input built from every positional argument, --file and "-"
+// (stdin), concatenated in order. Escapes such as \n are interpreted in
+// the arguments unless --raw is given.
 func Type(args []string) {
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: specter type <text>\n")
+	const usage = "Usage: specter type <text...|--file F|->... [--raw] [--delay 30ms] [--jitter 10ms] [--per-char]\n"
+
+	// typed is one piece of the input. Escapes are interpreted in text
+	// arguments unless --raw is given; file and stdin input is typed as it
+	// is, as paste and clipboard do.
+	type typed struct {
+		data string
+		arg  bool
+	}
+
+	var params protocol.TypeParams
+	var parts []typed
+	raw := false
+	// Consecutive text arguments are joined with spaces, as echo does, so
+	// "specter type ls -la" types "ls -la".
+	text := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if (arg == "--delay" || arg == "--jitter" || arg == "--file") && i+1 >= len(args) {
+			fmt.Fprintf(os.Stderr, "Missing value for %s\n%s", arg, usage)
+			os.Exit(1)
+		}
+		switch arg {
+		case "--per-char":
+			params.PerChar = true
+		case "--raw":
+			raw = true
+		case "--delay", "--jitter":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < 0 {
+				fmt.Fprintf(os.Stderr, "Invalid %s %q\n", arg, args[i+1])
+				os.Exit(1)
+			}
+			if arg == "--delay" {
+				params.Delay = protocol.Duration(d)
+			} else {
+				params.Jitter = protocol.Duration(d)
+			}
+			i++
+		case "--file":
+			data, err := os.ReadFile(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", args[i+1], err)
+				os.Exit(1)
+			}
+			parts = append(parts, typed{data: string(data)})
+			text = false
+			i++
+		case "-":
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+				os.Exit(1)
+			}
+			parts = append(parts, typed{data: string(data)})
+			text = false
+		default:
+			if text {
+				parts = append(parts, typed{data: " "})
+			}
+			parts = append(parts, typed{data: arg, arg: true})
+			text = true
+		}
+	}
+
+	if len(parts) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var b strings.Builder
+	for _, part := range parts {
+		if part.arg && !raw {
+			b.WriteString(unescape(part.data))
+		} else {
+			b.WriteString(part.data)
+		}
+	}
+	params.Text = b.String()
+
+	call(protocol.OpType, params, nil)
+}
+
+// Paste sends text as a paste: the server wraps it in bracketed-paste
+// markers if the application asked for them, so multi-line input is not
+// executed line by line.
+func Paste(args []string) {
+	var text string
+
+	switch {
+	case len(args) == 2 && args[0] == "--file":
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		text = string(data)
+	case len(args) == 1 && args[0] == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+			os.Exit(1)
+		}
+		text = string(data)
+	case len(args) == 1:
+		text = unescape(args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: specter paste <text|--file F|->\n")
+		os.Exit(1)
+	}
+
+	var result protocol.PasteResult
+	call(protocol.OpPaste, protocol.PasteParams{Text: text}, &result)
+
+	if !result.Bracketed {
+		fmt.Fprintf(os.Stderr, "Note: bracketed paste is not enabled; sent as plain input\n")
+	}
+}
+
+// Clipboard reads or sets the session's virtual clipboard, which programs
+// copy to and paste from with OSC 52.
+func Clipboard(args []string) {
+	const usage = "Usage: specter clipboard get [--selection c|p|s|0-7]\n" +
+		"       specter clipboard set <text|--file F|-> [--selection c|p|s|0-7]\n"
+
+	params := protocol.ClipboardParams{Selection: "c"}
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--selection" && i+1 < len(args):
+			params.Selection = args[i+1]
+			i++
+		case args[i] == "--file" && i+1 < len(args):
+			data, err := os.ReadFile(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", args[i+1], err)
+				os.Exit(1)
+			}
+			positional = append(positional, string(data))
+			i++
+		case args[i] == "-" && len(positional) == 1:
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+				os.Exit(1)
+			}
+			positional = append(positional, string(data))
+		case len(positional) == 1:
+			positional = append(positional, unescape(args[i]))
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+
+	switch {
+	case len(positional) == 1 && positional[0] == "get":
+		var result protocol.ClipboardResult
+		call(protocol.OpClipboard, params, &result)
+		fmt.Print(result.Text)
+	case len(positional) == 2 && positional[0] == "set":
+		params.Set = true
+		params.Text = positional[1]
+		call(protocol.OpClipboard, params, nil)
+	default:
+		fmt.Fprint(os.Stderr, usage)
 		os.Exit(1)
 	}
+}
+
+const mouseUsage = "Usage: specter mouse click|down|up|move|scroll <row> <col> [--button left|right|middle] [--mods C,M,S]\n" +
+	"       specter mouse drag <row> <col> <to-row> <to-col> [--button ...] [--mods ...]\n"
 
-	text := unescape(args[0])
+// Mouse sends a mouse action encoded for whatever tracking mode and
+// encoding the application enabled. Rows and columns are 0-based.
+func Mouse(args []string) {
+	var params protocol.MouseParams
+	var positional []string
 
-	req := protocol.Request{
-		Op:      protocol.OpType,
-		Payload: []string{text},
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--button" && i+1 < len(args):
+			params.Button = args[i+1]
+			i++
+		case args[i] == "--mods" && i+1 < len(args):
+			params.Mods = strings.Split(args[i+1], ",")
+			i++
+		default:
+			positional = append(positional, args[i])
+		}
 	}
-	sendRequestOrExit(req)
+
+	want := 3
+	if len(positional) > 0 && positional[0] == "drag" {
+		want = 5
+	}
+	if len(positional) != want {
+		fmt.Fprint(os.Stderr, mouseUsage)
+		os.Exit(1)
+	}
+
+	params.Action = positional[0]
+	coords := make([]int, len(positional)-1)
+	for i, p := range positional[1:] {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			fmt.Fprint(os.Stderr, mouseUsage)
+			os.Exit(1)
+		}
+		coords[i] = n
+	}
+	params.Row, params.Col = coords[0], coords[1]
+	if want == 5 {
+		params.ToRow, params.ToCol = coords[2], coords[3]
+	}
+
+	call(protocol.OpMouse, params, nil)
+}
+
+// Expect answers prompts automatically: each --on regex that matches new
+// output sends the following --send text, until --until matches or the
+// timeout expires. It prints the rules that fired as JSON.
+func Expect(args []string) {
+	const usage = "Usage: specter expect [--on <regex> --send <text>]... [--until <regex> [--until-screen]] [--timeout 30s]\n"
+
+	var params protocol.ExpectParams
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--until-screen" {
+			params.UntilScreen = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		switch args[i] {
+		case "--on":
+			params.Rules = append(params.Rules, protocol.ExpectRule{On: args[i+1]})
+		case "--send":
+			if len(params.Rules) == 0 || params.Rules[len(params.Rules)-1].Send != "" {
+				fmt.Fprintf(os.Stderr, "Each --send must follow an --on\n")
+				os.Exit(1)
+			}
+			params.Rules[len(params.Rules)-1].Send = unescape(args[i+1])
+		case "--until":
+			params.Until = args[i+1]
+		case "--timeout":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid timeout: %v\n", err)
+				os.Exit(1)
+			}
+			params.Timeout = protocol.Duration(d)
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		i++
+	}
+
+	c, err := Dial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter spawned?\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	var result protocol.ExpectResult
+	callErr := c.Call(protocol.OpExpect, params, &result)
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+
+	if callErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", callErr)
+		c.Close()
+		os.Exit(1)
+	}
+}
+
+// parseFindArgs splits find/click arguments into search params, the
+// remaining flags and the positional pattern.
+func parseFindArgs(args []string, usage string) (protocol.FindParams, []string) {
+	var params protocol.FindParams
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--regex":
+			params.Regex = true
+		case "--ignore-case", "-i":
+			params.IgnoreCase = true
+		default:
+			if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+				rest = append(rest, args[i], args[i+1])
+				i++
+			} else if params.Pattern == "" {
+				params.Pattern = args[i]
+			} else {
+				fmt.Fprint(os.Stderr, usage)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if params.Pattern == "" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	return params, rest
+}
+
+// Find prints the screen positions of text (or a regex) as JSON.
+func Find(args []string) {
+	params, _ := parseFindArgs(args, "Usage: specter find <text> [--regex] [--ignore-case]\n")
+
+	var result protocol.FindResult
+	call(protocol.OpFind, params, &result)
+
+	out, _ := json.MarshalIndent(result.Matches, "", "  ")
+	fmt.Println(string(out))
+
+	if len(result.Matches) == 0 {
+		os.Exit(1)
+	}
+}
+
+// Links prints the OSC 8 hyperlinks on screen with their text and
+// positions as JSON.
+func Links() {
+	var result protocol.LinksResult
+	call(protocol.OpLinks, nil, &result)
+
+	out, _ := json.MarshalIndent(result.Links, "", "  ")
+	fmt.Println(string(out))
+}
+
+// Click finds the nth (1-based) occurrence of text on screen and clicks the
+// middle of it.
+func Click(args []string) {
+	const usage = "Usage: specter click <text> [--nth N] [--regex] [--ignore-case] [--button B] [--mods C,M,S]\n"
+	params, rest := parseFindArgs(args, usage)
+
+	nth := 1
+	mouse := protocol.MouseParams{Action: "click"}
+	for i := 0; i < len(rest); i += 2 {
+		switch rest[i] {
+		case "--nth":
+			n, err := strconv.Atoi(rest[i+1])
+			if err != nil || n < 1 {
+				fmt.Fprint(os.Stderr, usage)
+				os.Exit(1)
+			}
+			nth = n
+		case "--button":
+			mouse.Button = rest[i+1]
+		case "--mods":
+			mouse.Mods = strings.Split(rest[i+1], ",")
+		}
+	}
+
+	c, err := Dial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter spawned?\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	var found protocol.FindResult
+	if err := c.Call(protocol.OpFind, params, &found); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+	if len(found.Matches) < nth {
+		fmt.Fprintf(os.Stderr, "Error: found %d matches for %q, wanted match %d\n", len(found.Matches), params.Pattern, nth)
+		c.Close()
+		os.Exit(1)
+	}
+
+	m := found.Matches[nth-1]
+	mouse.Row = m.Row
+	mouse.Col = (m.Col + m.EndCol - 1) / 2
+
+	if err := c.Call(protocol.OpMouse, mouse, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+
+	fmt.Printf("Clicked %q at %d,%d\n", m.Text, mouse.Row, mouse.Col)
 }
 
 func unescape(s string) string {
@@ -180,94 +747,318 @@ func parseHexByte(hex string) (byte, error) {
 }
 
 func Capture(args []string) {
-	format := "text"
+	params := protocol.CaptureParams{Format: "text"}
 	outputFile := ""
 
 	for i := 0; i < len(args); i++ {
 		if args[i] == "--format" && i+1 < len(args) {
-			format = args[i+1]
+			params.Format = args[i+1]
 			i++
 		} else if args[i] == "--out" && i+1 < len(args) {
 			outputFile = args[i+1]
 			i++
+		} else if args[i] == "--region" && i+1 < len(args) {
+			params.Region = args[i+1]
+			i++
+		} else if args[i] == "--trim" {
+			params.Trim = true
+		} else if args[i] == "--squeeze" {
+			params.Squeeze = true
+		} else if args[i] == "--numbered" {
+			params.Numbered = true
+		} else if args[i] == "--wrap-join" {
+			params.WrapJoin = true
+		} else if args[i] == "--title-bar" {
+			params.TitleBar = true
+		} else if args[i] == "--font" && i+1 < len(args) {
+			path, err := filepath.Abs(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid font path: %v\n", err)
+				os.Exit(1)
+			}
+			params.Fonts = append(params.Fonts, path)
+			i++
+		} else if args[i] == "--font-size" && i+1 < len(args) {
+			size, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid font size %q\n", args[i+1])
+				os.Exit(1)
+			}
+			params.FontSize = size
+			i++
+		} else if args[i] == "--scale" && i+1 < len(args) {
+			scale, err := strconv.ParseFloat(strings.TrimSuffix(args[i+1], "x"), 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid scale %q (use e.g. 2x)\n", args[i+1])
+				os.Exit(1)
+			}
+			params.Scale = scale
+			i++
+		} else if args[i] == "--padding" && i+1 < len(args) {
+			padding, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid padding %q\n", args[i+1])
+				os.Exit(1)
+			}
+			params.Padding = padding
+			i++
 		}
 	}
 
-	req := protocol.Request{
-		Op:      protocol.OpCapture,
-		Options: map[string]string{"format": format},
+	switch params.Format {
+	case "png", "html", "svg":
+		captureImage(params, outputFile)
+		return
 	}
 
-	resp, err := sendRequest(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\n", err)
-		os.Exit(1)
+	var result protocol.CaptureResult
+	call(protocol.OpCapture, params, &result)
+
+	output := result.Text
+	if result.Screen != nil {
+		out, _ := json.MarshalIndent(result.Screen, "", "  ")
+		output = string(out) + "\n"
 	}
 
-	if resp.Status != "ok" {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Message)
-		os.Exit(1)
+	if output != "" {
+		if outputFile != "" {
+			os.WriteFile(outputFile, []byte(output), 0644)
+		} else {
+			fmt.Print(output)
+		}
 	}
+}
 
-	if format == "png" {
-		data, err := base64.StdEncoding.DecodeString(resp.Data)
+// captureImage streams an image, HTML or SVG capture straight to
+// outputFile or stdout, or shows a PNG as an inline Kitty graphics preview
+// when stdout is a terminal.
+func captureImage(params protocol.CaptureParams, outputFile string) {
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding PNG data: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error writing to file: %v\n", err)
 			os.Exit(1)
 		}
+		fetch(protocol.OpCapture, params, nil, f)
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Screenshot saved to %s\n", outputFile)
+		return
+	}
 
-		if outputFile != "" {
-			if err := os.WriteFile(outputFile, data, 0644); err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing to file: %v\n", err)
-				os.Exit(1)
-			}
-			fmt.Printf("Screenshot saved to %s\n", outputFile)
-		} else {
-			fi, _ := os.Stdout.Stat()
-			if (fi.Mode() & os.ModeCharDevice) != 0 {
-				displayImageKitty(resp.Data)
-			} else {
-				os.Stdout.Write(data)
-			}
+	fi, _ := os.Stdout.Stat()
+	if (fi.Mode()&os.ModeCharDevice) == 0 || params.Format != "png" {
+		fetch(protocol.OpCapture, params, nil, os.Stdout)
+		return
+	}
+
+	var buf bytes.Buffer
+	fetch(protocol.OpCapture, params, nil, &buf)
+	displayImageKitty(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func History(args []string) {
+	asJSON := false
+	for _, arg := range args {
+		if arg == "--json" {
+			asJSON = true
 		}
-	} else {
-		if resp.Data != "" {
-			if outputFile != "" {
-				os.WriteFile(outputFile, []byte(resp.Data), 0644)
-			} else {
-				fmt.Print(resp.Data)
-			}
+	}
+
+	var result protocol.HistoryResult
+	call(protocol.OpHistory, nil, &result)
+
+	if asJSON {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	var start time.Time
+	for i, ev := range result.Events {
+		if i == 0 {
+			start = ev.Time
 		}
+		offset := ev.Time.Sub(start).Seconds()
+
+		var detail string
+		switch ev.Kind {
+		case protocol.InputResize:
+			detail = fmt.Sprintf("%dx%d", ev.Rows, ev.Cols)
+		case protocol.InputSignal:
+			detail = "SIG" + ev.Signal
+		default:
+			detail = fmt.Sprintf("%q", ev.Data)
+		}
+		fmt.Printf("%d: +%.3fs %-6s %s  (%s)\n", i, offset, ev.Kind, detail, ev.Client)
 	}
 }
 
-func History() {
-	req := protocol.Request{
-		Op: protocol.OpHistory,
+// Replay re-sends the events of a `history --json` file to the session,
+// preserving their relative timing. If no session is running, one is
+// spawned with the recorded command first.
+func Replay(args []string) {
+	file := ""
+	speed := 1.0
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--speed" && i+1 < len(args) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(args[i+1], "x"), 64)
+			if err != nil || v <= 0 {
+				fmt.Fprintf(os.Stderr, "Invalid speed %q (use e.g. 2x or 0.5x)\n", args[i+1])
+				os.Exit(1)
+			}
+			speed = v
+			i++
+		} else if file == "" {
+			file = args[i]
+		}
 	}
 
-	resp, err := sendRequest(req)
+	if file == "" {
+		fmt.Fprintf(os.Stderr, "Usage: specter replay <history.json> [--speed 2x]\n")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	var hist protocol.HistoryResult
+	if err := json.Unmarshal(data, &hist); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", file, err)
+		os.Exit(1)
+	}
+
+	// Events are replayed into a fresh session, since anything typed into
+	// a running one already would not reproduce the recording.
+	if _, err := os.Stat(server.SocketName); err == nil {
+		fmt.Fprintf(os.Stderr, "Specter already running (socket exists: %s); run 'specter kill' to replay into a fresh session\n", server.SocketName)
+		os.Exit(1)
+	}
+	if len(hist.Command) == 0 {
+		fmt.Fprintf(os.Stderr, "%s records no command to spawn\n", file)
+		os.Exit(1)
+	}
+	Spawn(append([]string{"--"}, hist.Command...))
+
+	c, err := Dial()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\n", err)
 		os.Exit(1)
 	}
+	defer c.Close()
 
-	if resp.Status != "ok" {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Message)
+	// Let the program start up before the first event, as it had when the
+	// events were recorded. Programs that never settle are replayed into
+	// anyway once the wait times out.
+	err = c.Call(protocol.OpWaitStable, nil, nil)
+	if perr, ok := err.(*protocol.Error); err != nil && !(ok && perr.Code == protocol.ErrTimeout) {
+		fmt.Fprintf(os.Stderr, "Error waiting for the session to start: %v\n", err)
+		c.Close()
 		os.Exit(1)
 	}
 
-	var history []string
-	if err := json.Unmarshal([]byte(resp.Data), &history); err != nil {
-		fmt.Println(resp.Data)
-		return
+	for i, ev := range hist.Events {
+		if i > 0 {
+			gap := ev.Time.Sub(hist.Events[i-1].Time)
+			time.Sleep(time.Duration(float64(gap) / speed))
+		}
+
+		var err error
+		switch ev.Kind {
+		case protocol.InputResize:
+			err = c.Call(protocol.OpResize, protocol.ResizeParams{Rows: ev.Rows, Cols: ev.Cols}, nil)
+		case protocol.InputSignal:
+			err = c.Call(protocol.OpSignal, protocol.SignalParams{Signal: ev.Signal}, nil)
+		default:
+			err = c.Call(protocol.OpType, protocol.TypeParams{Text: string(ev.Data), Kind: ev.Kind}, nil)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error replaying event %d: %v\n", i, err)
+			c.Close()
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Replayed %d events\n", len(hist.Events))
+}
+
+// Output prints the raw PTY output log: one timestamped, quoted chunk per
+// line by default, the concatenated bytes with --raw, or just the text
+// with --strip-ansi.
+func Output(args []string) {
+	mode := "log"
+	for _, arg := range args {
+		switch arg {
+		case "--raw":
+			mode = "raw"
+		case "--strip-ansi":
+			mode = "strip"
+		case "--json":
+			mode = "json"
+		}
+	}
+
+	var result protocol.OutputResult
+	var body bytes.Buffer
+	fetch(protocol.OpOutput, nil, &result, &body)
+	if err := result.SetData(body.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	for i, entry := range history {
-		fmt.Printf("%d: %q\n", i, entry)
+	switch mode {
+	case "json":
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	case "log":
+		if result.Dropped > 0 {
+			fmt.Printf("# %d earlier chunks dropped\n", result.Dropped)
+		}
+		for _, chunk := range result.Chunks {
+			fmt.Printf("%12.6f %q\n", time.Duration(chunk.Offset).Seconds(), chunk.Data)
+		}
+	default:
+		var all []byte
+		for _, chunk := range result.Chunks {
+			all = append(all, chunk.Data...)
+		}
+		if mode == "strip" {
+			all = ansi.Strip(bytes.ReplaceAll(all, []byte("\r\n"), []byte("\n")))
+		}
+		os.Stdout.Write(all)
 	}
 }
 
+func Resize(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: specter resize <rows> <cols>\n")
+		os.Exit(1)
+	}
+
+	rows, err1 := strconv.Atoi(args[0])
+	cols, err2 := strconv.Atoi(args[1])
+	if err1 != nil || err2 != nil {
+		fmt.Fprintf(os.Stderr, "Usage: specter resize <rows> <cols>\n")
+		os.Exit(1)
+	}
+
+	call(protocol.OpResize, protocol.ResizeParams{Rows: rows, Cols: cols}, nil)
+}
+
+func Signal(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: specter signal <INT|TERM|HUP|...>\n")
+		os.Exit(1)
+	}
+
+	call(protocol.OpSignal, protocol.SignalParams{Signal: args[0]}, nil)
+}
+
 func displayImageKitty(b64Data string) {
 	const chunkSize = 4096
 
@@ -292,28 +1083,308 @@ func displayImageKitty(b64Data string) {
 	fmt.Println()
 }
 
-func Wait() {
-	req := protocol.Request{
-		Op: protocol.OpWait,
+func Wait(args []string) {
+	var params protocol.WaitParams
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--timeout" && i+1 < len(args) {
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid timeout: %v\n", err)
+				os.Exit(1)
+			}
+			params.Timeout = protocol.Duration(d)
+			i++
+		}
 	}
-	sendRequestOrExit(req)
+
+	var result protocol.WaitResult
+	call(protocol.OpWait, params, &result)
+
+	fmt.Printf("%d", result.ExitCode)
 }
 
-func Kill() {
-	req := protocol.Request{
-		Op: protocol.OpKill,
+func WaitStable(args []string) {
+	var params protocol.WaitStableParams
+
+	for i := 0; i < len(args); i++ {
+		var target *protocol.Duration
+		switch args[i] {
+		case "--quiet":
+			target = &params.Quiet
+		case "--timeout":
+			target = &params.Timeout
+		default:
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Fprintf(os.Stderr, "Missing value for %s\n", args[i])
+			os.Exit(1)
+		}
+		d, err := time.ParseDuration(args[i+1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", args[i], err)
+			os.Exit(1)
+		}
+		*target = protocol.Duration(d)
+		i++
+	}
+
+	call(protocol.OpWaitStable, params, nil)
+}
+
+// Status prints the session's command, process state, size and title.
+func Status(args []string) {
+	var result protocol.StatusResult
+	call(protocol.OpStatus, nil, &result)
+
+	if slices.Contains(args, "--json") {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	state := "running"
+	if result.Exited {
+		state = fmt.Sprintf("exited (%d)", result.ExitCode)
+	}
+	fmt.Printf("command:   %s\n", strings.Join(result.Command, " "))
+	fmt.Printf("pid:       %d\n", result.Pid)
+	fmt.Printf("state:     %s\n", state)
+	fmt.Printf("size:      %dx%d\n", result.Rows, result.Cols)
+	fmt.Printf("title:     %s\n", result.Title)
+	fmt.Printf("icon name: %s\n", result.IconName)
+	fmt.Printf("bells:     %d\n", result.Bells)
+	fmt.Printf("notified:  %d\n", result.Notifications)
+	if result.OutputLogError != "" {
+		fmt.Printf("log error: %s\n", result.OutputLogError)
+	}
+}
+
+// Events prints the bells and desktop notifications the program sent.
+func Events(args []string) {
+	var result protocol.EventsResult
+	call(protocol.OpEvents, nil, &result)
+
+	if slices.Contains(args, "--json") {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if result.Dropped > 0 {
+		fmt.Printf("(%d earlier events dropped)\n", result.Dropped)
+	}
+	for _, ev := range result.Events {
+		detail := ""
+		if ev.Kind == protocol.EventNotify {
+			detail = ev.Body
+			if ev.Title != "" {
+				detail = ev.Title + ": " + ev.Body
+			}
+		}
+		fmt.Printf("%s %-6s %s\n", ev.Time.Format("15:04:05.000"), ev.Kind, detail)
+	}
+}
+
+// Title prints the window title, or with --icon the icon name.
+func Title(args []string) {
+	var result protocol.TitleResult
+	call(protocol.OpTitle, nil, &result)
+
+	switch {
+	case slices.Contains(args, "--json"):
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	case slices.Contains(args, "--icon"):
+		fmt.Println(result.IconName)
+	default:
+		fmt.Println(result.Title)
+	}
+}
+
+// Modes prints the terminal modes the program has set, under the names
+// wait-for --mode uses.
+func Modes(args []string) {
+	var result protocol.Modes
+	call(protocol.OpModes, nil, &result)
+
+	if slices.Contains(args, "--json") {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	fmt.Printf("altscreen:       %s\n", onOff(result.AltScreen))
+	fmt.Printf("app_cursor:      %s\n", onOff(result.AppCursor))
+	fmt.Printf("app_keypad:      %s\n", onOff(result.AppKeypad))
+	fmt.Printf("bracketed_paste: %s\n", onOff(result.BracketedPaste))
+	fmt.Printf("focus:           %s\n", onOff(result.Focus))
+	fmt.Printf("cursor_visible:  %s\n", onOff(result.CursorVisible))
+	fmt.Printf("autowrap:        %s\n", onOff(result.Autowrap))
+	fmt.Printf("mouse:           %s\n", result.Mouse)
+	fmt.Printf("mouse_encoding:  %s\n", result.MouseEncoding)
+}
+
+// WaitFor blocks until terminal state matches every condition given.
+func WaitFor(args []string) {
+	const usage = "Usage: specter wait-for [--title <regex>] [--bell] [--mode name=value]... [--timeout 10s]\n"
+
+	var params protocol.WaitForParams
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--bell" {
+			params.Bell = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		switch args[i] {
+		case "--title":
+			params.Title = args[i+1]
+		case "--mode":
+			params.Modes = append(params.Modes, args[i+1])
+		case "--timeout":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid timeout: %v\n", err)
+				os.Exit(1)
+			}
+			params.Timeout = protocol.Duration(d)
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		i++
+	}
+
+	var result protocol.WaitForResult
+	call(protocol.OpWaitFor, params, &result)
+
+	fmt.Println(result.Title)
+}
+
+// Batch reads JSON-lines requests from stdin and runs them on the server as
+// one uninterrupted sequence, printing one JSON response per executed step.
+func Batch(args []string) {
+	var params protocol.BatchParams
+
+	for _, arg := range args {
+		if arg == "--continue" {
+			params.ContinueOnError = true
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var step protocol.Request
+		if err := json.Unmarshal([]byte(text), &step); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid step on line %d: %v\n", line, err)
+			os.Exit(1)
+		}
+		if step.ID == "" {
+			step.ID = strconv.Itoa(line)
+		}
+		params.Steps = append(params.Steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading steps: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := Dial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter spawned?\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	if !c.Has(protocol.FeatureBatch) {
+		fmt.Fprintf(os.Stderr, "Error: server does not support batches; respawn specter with this binary\n")
+		c.Close()
+		os.Exit(1)
+	}
+
+	var result protocol.BatchResult
+	if err := c.Call(protocol.OpBatch, params, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	failed := len(result.Steps) < len(params.Steps)
+	for _, step := range result.Steps {
+		encoder.Encode(step)
+		if step.Status != protocol.StatusOK {
+			failed = true
+		}
 	}
 
-	resp, err := sendRequest(req)
+	if failed {
+		c.Close()
+		os.Exit(1)
+	}
+}
+
+func Kill() {
+	c, err := Dial()
+	if errors.Is(err, errUnversioned) {
+		err = killUnversioned()
+		if err == nil {
+			fmt.Println("Specter terminated")
+			return
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error connecting to server: %v\nIs specter running?\n", err)
 		os.Exit(1)
 	}
+	defer c.Close()
 
-	if resp.Status != "ok" {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Message)
+	if err := c.Call(protocol.OpKill, nil, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		c.Close()
 		os.Exit(1)
 	}
 
 	fmt.Println("Specter terminated")
 }
+
+// killUnversioned stops a server predating the hello exchange, sending the
+// bare kill request those servers expect on a connection of its own.
+func killUnversioned() error {
+	conn, err := net.Dial("unix", server.SocketName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := struct {
+		Op protocol.Op `json:"op"`
+	}{protocol.OpKill}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	var resp protocol.Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Status != protocol.StatusOK {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// FeatureFramed switches a connection from newline-delimited JSON to
+// length-prefixed frames once the hello exchange completes. It is enabled
+// when the client asks for it and the server advertises it, and lets bulk
+// payloads such as screenshots travel as raw bytes instead of base64.
+const FeatureFramed = "framed"
+
+// A frame is a 12-byte preamble holding the big-endian lengths of the JSON
+// header (uint32) and the raw body (uint64), followed by the header and the
+// body themselves.
+const framePreambleSize = 12
+
+// maxHeaderSize bounds the JSON header so a corrupt preamble cannot make the
+// reader allocate arbitrary amounts of memory. Bodies are streamed instead.
+const maxHeaderSize = 16 << 20
+
+// A Payload is a frame body of known length. It is written with WriteTo,
+// so a large body can be streamed instead of assembled in memory first.
+type Payload interface {
+	io.WriterTo
+	Size() int64
+}
+
+// Bytes returns a Payload over b.
+func Bytes(b []byte) Payload {
+	return bytes.NewReader(b)
+}
+
+// WriteFrame writes header as JSON followed by body, which may be nil, as
+// raw bytes.
+func WriteFrame(w io.Writer, header interface{}, body Payload) error {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if body != nil {
+		size = body.Size()
+	}
+
+	var pre [framePreambleSize]byte
+	binary.BigEndian.PutUint32(pre[0:4], uint32(len(h)))
+	binary.BigEndian.PutUint64(pre[4:12], uint64(size))
+
+	if _, err := w.Write(pre[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	if size > 0 {
+		n, err := body.WriteTo(w)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("frame body is %d bytes, expected %d", n, size)
+		}
+	}
+	return nil
+}
+
+// ReadFrame decodes the next frame's header into header and returns a
+// reader over its body and the body length. The body must be consumed
+// before the next call to ReadFrame.
+func ReadFrame(r io.Reader, header interface{}) (io.Reader, int64, error) {
+	var pre [framePreambleSize]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil {
+		return nil, 0, err
+	}
+
+	headerLen := binary.BigEndian.Uint32(pre[0:4])
+	bodyLen := binary.BigEndian.Uint64(pre[4:12])
+	if headerLen > maxHeaderSize {
+		return nil, 0, fmt.Errorf("frame header too large (%d bytes)", headerLen)
+	}
+
+	h := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(h, header); err != nil {
+		return nil, 0, err
+	}
+
+	return io.LimitReader(r, int64(bodyLen)), int64(bodyLen), nil
+}
+
+// FrameReader returns a reader for frames that follow the JSON hello on r,
+// starting with whatever dec has already buffered past the hello message.
+func FrameReader(dec *json.Decoder, r io.Reader) io.Reader {
+	buffered, _ := io.ReadAll(dec.Buffered())
+	// json.Encoder terminates every message with a newline.
+	buffered = bytes.TrimLeft(buffered, " \t\r\n")
+	return bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), r))
+}
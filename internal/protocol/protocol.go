@@ -1,23 +1,602 @@
 package protocol
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is the protocol version spoken by this binary. It is bumped
+// whenever a change would be misread by a peer built from older sources.
+const Version = 2
+
+// MinVersion is the oldest peer version this binary can still talk to.
+const MinVersion = 2
+
 type Op string
 
 const (
+	OpHello   Op = "hello"
 	OpType    Op = "type"
 	OpCapture Op = "capture"
 	OpHistory Op = "history"
 	OpWait    Op = "wait"
 	OpKill    Op = "kill"
+
+	OpWaitStable Op = "wait-stable"
+	OpBatch      Op = "batch"
+	OpResize     Op = "resize"
+	OpSignal     Op = "signal"
+	OpOutput     Op = "output"
+	OpPaste      Op = "paste"
+	OpMouse      Op = "mouse"
+	OpFind       Op = "find"
+	OpExpect     Op = "expect"
+	OpStatus     Op = "status"
+	OpTitle      Op = "title"
+	OpWaitFor    Op = "wait-for"
+	OpEvents     Op = "events"
+	OpClipboard  Op = "clipboard"
+	OpLinks      Op = "links"
+	OpModes      Op = "modes"
+)
+
+type Status string
+
+const (
+	StatusOK    Status = "ok"
+	StatusError Status = "error"
 )
 
+// ErrorCode is a machine-readable reason attached to error responses.
+type ErrorCode string
+
+const (
+	ErrBadRequest    ErrorCode = "bad_request"
+	ErrUnknownOp     ErrorCode = "unknown_op"
+	ErrIncompatible  ErrorCode = "incompatible_version"
+	ErrNoSession     ErrorCode = "no_session"
+	ErrProcessExited ErrorCode = "process_exited"
+	ErrTimeout       ErrorCode = "timeout"
+	ErrInternal      ErrorCode = "internal"
+)
+
+// Request IDs are chosen by the client and echoed in the matching
+// response, so a client may pipeline several requests on one connection.
+// The server answers them in the order they were sent.
 type Request struct {
-	Op      Op                `json:"op"`
-	Payload []string          `json:"payload,omitempty"`
-	Options map[string]string `json:"options,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Op     Op              `json:"op"`
+	Params json.RawMessage `json:"params,omitempty"`
 }
 
 type Response struct {
-	Status  string `json:"status"` // "ok" or "error"
-	Message string `json:"message,omitempty"`
-	Data    string `json:"data,omitempty"` // For capture output
+	ID      string          `json:"id,omitempty"`
+	Status  Status          `json:"status"`
+	Code    ErrorCode       `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+
+	// Body carries bulk binary output such as PNG data, base64-encoded
+	// inside the JSON. On framed connections it is sent raw after the
+	// header instead.
+	Body []byte `json:"body,omitempty"`
+
+	// Payload is bulk output the server has not read into Body yet. Framed
+	// connections stream it as the frame body; elsewhere Inline moves it
+	// into Body before the response is encoded.
+	Payload Payload `json:"-"`
+}
+
+// Inline reads the response's Payload into Body.
+func (r *Response) Inline() error {
+	if r.Payload == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(r.Payload.Size()))
+	if _, err := r.Payload.WriteTo(&buf); err != nil {
+		return err
+	}
+	r.Body, r.Payload = buf.Bytes(), nil
+	return nil
+}
+
+// Hello is exchanged as the first request and response on every
+// connection. The server answers with the highest version both sides
+// support, or ErrIncompatible if their ranges do not overlap.
+type Hello struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Features   []string `json:"features,omitempty"`
+
+	// Client identifies the sender in input history, e.g. "specter/4242".
+	Client string `json:"client,omitempty"`
+}
+
+// FeatureBatch marks servers that accept OpBatch.
+const FeatureBatch = "batch"
+
+type TypeParams struct {
+	Text string `json:"text"`
+
+	// Kind is recorded in the input history. When empty the server picks
+	// InputKey for a lone control character or escape sequence and
+	// InputText otherwise.
+	Kind InputKind `json:"kind,omitempty"`
+
+	// With PerChar or a non-zero Delay, Text is written one keystroke at a
+	// time (a character, or a whole escape sequence), Delay ± Jitter apart.
+	// The request completes after the last keystroke is written.
+	PerChar bool     `json:"per_char,omitempty"`
+	Delay   Duration `json:"delay,omitempty"`
+	Jitter  Duration `json:"jitter,omitempty"`
+}
+
+// PasteParams sends Text wrapped in bracketed-paste markers when the
+// application has enabled mode 2004, and as plain input otherwise.
+type PasteParams struct {
+	Text string `json:"text"`
+}
+
+type PasteResult struct {
+	Bracketed bool `json:"bracketed"`
+}
+
+// MouseParams describes a mouse action at a 0-based screen position.
+// Action is one of click, down, up, move, drag (to ToRow/ToCol) or scroll.
+// Button is left, middle or right, or for scroll the wheel direction up,
+// down, left or right. Mods may contain "C", "M" and "S".
+type MouseParams struct {
+	Action string   `json:"action"`
+	Row    int      `json:"row"`
+	Col    int      `json:"col"`
+	ToRow  int      `json:"to_row,omitempty"`
+	ToCol  int      `json:"to_col,omitempty"`
+	Button string   `json:"button,omitempty"`
+	Mods   []string `json:"mods,omitempty"`
+}
+
+// MouseResult reports the tracking mode and encoding the events were
+// sent with.
+type MouseResult struct {
+	Tracking string `json:"tracking"`
+	Encoding string `json:"encoding"`
+}
+
+type InputKind string
+
+const (
+	InputText   InputKind = "text"
+	InputKey    InputKind = "key"
+	InputPaste  InputKind = "paste"
+	InputMouse  InputKind = "mouse"
+	InputResize InputKind = "resize"
+	InputSignal InputKind = "signal"
+)
+
+// InputEvent is one entry of a session's input history. Data holds the
+// exact bytes written to the PTY; resize and signal events use the Rows,
+// Cols and Signal fields instead.
+type InputEvent struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Kind   InputKind `json:"kind"`
+	Data   []byte    `json:"data,omitempty"`
+	Rows   int       `json:"rows,omitempty"`
+	Cols   int       `json:"cols,omitempty"`
+	Signal string    `json:"signal,omitempty"`
+}
+
+type CaptureParams struct {
+	Format string `json:"format,omitempty"` // "text" (default), "json", "png", "html" or "svg"
+
+	// Region limits the capture to part of the screen: "top,left,bottom,
+	// right" (0-based, inclusive), "line:N" (negative counts from the
+	// bottom), "last-line" or "cursor-line". Empty means the whole screen.
+	Region string `json:"region,omitempty"`
+
+	// Text capture options. Trim drops trailing spaces and trailing blank
+	// lines, Squeeze collapses runs of blank lines into one, Numbered
+	// prefixes each line with its 0-based screen row, and WrapJoin joins
+	// rows the terminal soft-wrapped back into one line.
+	Trim     bool `json:"trim,omitempty"`
+	Squeeze  bool `json:"squeeze,omitempty"`
+	Numbered bool `json:"numbered,omitempty"`
+	WrapJoin bool `json:"wrap_join,omitempty"`
+
+	// Screenshot options. Fonts lists font files to draw with, the first
+	// being the primary font and the rest fallbacks for characters it
+	// lacks; system fallbacks and GoMono follow. FontSize is in points
+	// (default 12), Scale multiplies the resolution (default 1) and
+	// Padding adds a border of that many unscaled pixels.
+	Fonts    []string `json:"fonts,omitempty"`
+	FontSize float64  `json:"font_size,omitempty"`
+	Scale    float64  `json:"scale,omitempty"`
+	Padding  int      `json:"padding,omitempty"`
+
+	// TitleBar draws the window title in a strip above the screen.
+	TitleBar bool `json:"title_bar,omitempty"`
+}
+
+// CaptureResult holds text and JSON captures inline. PNG, HTML and SVG
+// captures are returned in the response body.
+type CaptureResult struct {
+	Text   string  `json:"text,omitempty"`
+	Screen *Screen `json:"screen,omitempty"`
+}
+
+// Region is a 0-based, inclusive rectangle of cells.
+type Region struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Bottom int `json:"bottom"`
+	Right  int `json:"right"`
+}
+
+type Cursor struct {
+	Row     int    `json:"row"`
+	Col     int    `json:"col"`
+	Visible bool   `json:"visible"`
+	Shape   string `json:"shape,omitempty"` // "block", "underline" or "bar"
+}
+
+// Screen is the JSON capture format. Lines cover Region only; the cursor
+// is given in full-screen coordinates.
+type Screen struct {
+	Rows     int      `json:"rows"`
+	Cols     int      `json:"cols"`
+	Region   Region   `json:"region"`
+	Cursor   Cursor   `json:"cursor"`
+	Title    string   `json:"title,omitempty"`
+	IconName string   `json:"icon_name,omitempty"`
+	Modes    Modes    `json:"modes"`
+	Lines    []string `json:"lines"`
+	Links    []Link   `json:"links,omitempty"`
+	Images   []Image  `json:"images,omitempty"`
+}
+
+// Modes are the terminal modes the program has set. Mouse is the tracking
+// mode ("off", "x10", "normal", "button-event" or "any-event") and
+// MouseEncoding how reports are encoded ("x10", "utf8", "sgr" or "urxvt").
+// The JSON names are also the names wait-for accepts.
+type Modes struct {
+	AltScreen      bool   `json:"altscreen"`
+	AppCursor      bool   `json:"app_cursor"`
+	AppKeypad      bool   `json:"app_keypad"`
+	BracketedPaste bool   `json:"bracketed_paste"`
+	Focus          bool   `json:"focus"`
+	CursorVisible  bool   `json:"cursor_visible"`
+	Autowrap       bool   `json:"autowrap"`
+	Mouse          string `json:"mouse"`
+	MouseEncoding  string `json:"mouse_encoding"`
+}
+
+// FindParams searches the visible screen row by row. Pattern is literal
+// text unless Regex is set.
+type FindParams struct {
+	Pattern    string `json:"pattern"`
+	Regex      bool   `json:"regex,omitempty"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+}
+
+// Match is a 0-based cell span on one row; EndCol is exclusive.
+type Match struct {
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	EndCol int    `json:"end_col"`
+	Text   string `json:"text"`
+}
+
+type FindResult struct {
+	Matches []Match `json:"matches"`
+}
+
+// Link is the part of an OSC 8 hyperlink on one row. EndCol is exclusive.
+type Link struct {
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	EndCol int    `json:"end_col"`
+	Text   string `json:"text"`
+	URI    string `json:"uri"`
+}
+
+type LinksResult struct {
+	Links []Link `json:"links"`
+}
+
+// Image is a picture a program showed with the kitty graphics protocol
+// ("kitty") or sixel ("sixel"), placed at Row, Col and covering Rows by
+// Cols cells, which may extend past the captured region. Width and Height
+// are the decoded image's size in pixels; ID is the kitty image id, if the
+// program gave one.
+type Image struct {
+	Protocol string `json:"protocol"`
+	ID       int    `json:"id,omitempty"`
+	Row      int    `json:"row"`
+	Col      int    `json:"col"`
+	Rows     int    `json:"rows"`
+	Cols     int    `json:"cols"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// ExpectRule sends Send each time On matches new output.
+type ExpectRule struct {
+	On   string `json:"on"`
+	Send string `json:"send"`
+}
+
+// ExpectParams watches output not yet answered, that is produced after the
+// last input or the last expect. Rules are answered in the order their
+// prompts appear; the request succeeds once Until matches that output, or,
+// with no Until, when the process exits.
+//
+// With UntilScreen, Until is also matched against the whole screen, for
+// programs that draw their text with cursor movement. The screen can still
+// show text from before the request, so only use it with a pattern that
+// cannot match stale output.
+type ExpectParams struct {
+	Rules       []ExpectRule `json:"rules,omitempty"`
+	Until       string       `json:"until,omitempty"`
+	UntilScreen bool         `json:"until_screen,omitempty"`
+	Timeout     Duration     `json:"timeout,omitempty"`
+}
+
+type FiredRule struct {
+	Rule  int       `json:"rule"`
+	On    string    `json:"on"`
+	Match string    `json:"match"`
+	Time  time.Time `json:"time"`
+}
+
+// ExpectResult is also attached to timeout and process_exited errors, so
+// callers can see how far the interaction got.
+type ExpectResult struct {
+	Fired []FiredRule `json:"fired"`
+	Until string      `json:"until,omitempty"`
+}
+
+// HistoryResult is also the file format read by `specter replay`.
+type HistoryResult struct {
+	Command []string     `json:"command"`
+	Events  []InputEvent `json:"events"`
+}
+
+// OutputChunk is one read from the PTY. Offset is measured from session
+// start on the monotonic clock.
+type OutputChunk struct {
+	Offset Duration `json:"offset"`
+	Size   int      `json:"size"`
+	Data   []byte   `json:"data,omitempty"`
+}
+
+// OutputResult holds the raw output log. Dropped counts chunks discarded
+// from the front once the log exceeded its memory bound.
+//
+// The log can be larger than a response header may be, so the server sends
+// the chunks' bytes one after another in the response body and leaves Data
+// empty; SetData hands them back out by Size.
+type OutputResult struct {
+	Chunks  []OutputChunk `json:"chunks"`
+	Dropped int           `json:"dropped,omitempty"`
+}
+
+// SetData fills in each chunk's Data from the response body.
+func (r *OutputResult) SetData(body []byte) error {
+	for i := range r.Chunks {
+		size := r.Chunks[i].Size
+		if size < 0 || size > len(body) {
+			return fmt.Errorf("output body is shorter than its chunks")
+		}
+		r.Chunks[i].Data, body = body[:size:size], body[size:]
+	}
+	if len(body) > 0 {
+		return fmt.Errorf("output body is longer than its chunks")
+	}
+	return nil
+}
+
+// StatusResult describes the session.
+type StatusResult struct {
+	Command  []string `json:"command"`
+	Pid      int      `json:"pid"`
+	Exited   bool     `json:"exited"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Rows     int      `json:"rows"`
+	Cols     int      `json:"cols"`
+	Title    string   `json:"title,omitempty"`
+	IconName string   `json:"icon_name,omitempty"`
+
+	// Bells and Notifications count events since spawn.
+	Bells         int `json:"bells"`
+	Notifications int `json:"notifications"`
+
+	// OutputLogError is the error that stopped writes to the --output-log
+	// file, if any.
+	OutputLogError string `json:"output_log_error,omitempty"`
+}
+
+// TitleResult holds the window title and icon name set with OSC 0, 1
+// and 2.
+type TitleResult struct {
+	Title    string `json:"title"`
+	IconName string `json:"icon_name"`
+}
+
+// WaitForParams waits until every condition given holds. Title is a regex
+// matched against the window title; Bell requires a bell since the last
+// input; each of Modes is "name=value" for a mode in Modes, with "on" or
+// "off" for the boolean ones, e.g. "altscreen=off".
+type WaitForParams struct {
+	Title   string   `json:"title,omitempty"`
+	Bell    bool     `json:"bell,omitempty"`
+	Modes   []string `json:"modes,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+type WaitForResult struct {
+	Title string `json:"title"`
+}
+
+type EventKind string
+
+const (
+	EventBell   EventKind = "bell"
+	EventNotify EventKind = "notify" // OSC 9 or OSC 777;notify
+)
+
+// Event is a bell or desktop notification sent by the program.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Kind  EventKind `json:"kind"`
+	Title string    `json:"title,omitempty"`
+	Body  string    `json:"body,omitempty"`
+}
+
+// EventsResult lists events oldest first. Dropped counts events discarded
+// from the front once the list exceeded its bound.
+type EventsResult struct {
+	Events  []Event `json:"events"`
+	Dropped int     `json:"dropped,omitempty"`
+}
+
+// ClipboardParams reads the virtual clipboard that programs write with
+// OSC 52, or with Set replaces its contents, which then answer OSC 52
+// queries. Selection is "c" (the default), "p", "s" or "0"-"7".
+type ClipboardParams struct {
+	Selection string `json:"selection,omitempty"`
+	Set       bool   `json:"set,omitempty"`
+	Text      string `json:"text,omitempty"`
+}
+
+type ClipboardResult struct {
+	Text string `json:"text"`
+}
+
+type ResizeParams struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+type SignalParams struct {
+	Signal string `json:"signal"` // e.g. "INT", "TERM", "WINCH"
+}
+
+type WaitParams struct {
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+type WaitResult struct {
+	ExitCode int `json:"exit_code"`
+}
+
+type KillResult struct{}
+
+type WaitStableParams struct {
+	// Quiet is how long the program must produce no output.
+	Quiet   Duration `json:"quiet,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// BatchParams runs Steps in order while no other client request is
+// processed. Execution stops at the first failing step unless
+// ContinueOnError is set.
+type BatchParams struct {
+	Steps           []Request `json:"steps"`
+	ContinueOnError bool      `json:"continue_on_error,omitempty"`
+}
+
+// BatchResult holds one response per executed step, carrying the step's
+// request ID. Steps skipped after a failure have no response.
+type BatchResult struct {
+	Steps []Response `json:"steps"`
+}
+
+// Duration is a time.Duration that travels as a Go duration string ("5s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Error is the client-side form of an error response.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewRequest builds a request for op with params marshalled as JSON. A nil
+// params value produces a request without a params field.
+func NewRequest(op Op, params interface{}) (Request, error) {
+	req := Request{Op: op}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return Request{}, err
+		}
+		req.Params = b
+	}
+	return req, nil
+}
+
+// DecodeParams unmarshals the request params into v. Missing params leave v
+// untouched.
+func (r Request) DecodeParams(v interface{}) error {
+	if len(r.Params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Params, v)
+}
+
+// OK builds a successful response carrying result.
+func OK(result interface{}) Response {
+	resp := Response{Status: StatusOK}
+	if result != nil {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return Errorf(ErrInternal, "Failed to marshal result: %v", err)
+		}
+		resp.Result = b
+	}
+	return resp
+}
+
+// Errorf builds an error response with the given code.
+func Errorf(code ErrorCode, format string, args ...interface{}) Response {
+	return Response{Status: StatusError, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Err returns the response as an *Error, or nil if it succeeded.
+func (r Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return &Error{Code: r.Code, Message: r.Message}
+}
+
+// DecodeResult unmarshals the response result into v.
+func (r Response) DecodeResult(v interface{}) error {
+	if len(r.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Result, v)
 }
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/base64"
+	"specter/internal/protocol"
+	"strings"
+)
+
+// setClipboard handles OSC 52: "Pc;Pd", where Pc names the selections
+// (c for clipboard, p for primary, s and 0-7 for cut buffers) and Pd is
+// base64 data, or "?" to query. xterm defaults an empty Pc to "s0"; here
+// it means the clipboard, which is what programs sending it expect.
+func (t *termState) setClipboard(arg string) {
+	sel, data, ok := strings.Cut(arg, ";")
+	if !ok {
+		return
+	}
+	if sel == "" {
+		sel = "c"
+	}
+
+	if data == "?" {
+		name := []rune(sel)[0]
+		t.ask([]byte("\x1b]52;" + string(name) + ";" + base64.StdEncoding.EncodeToString(t.clipboard[name]) + "\x1b\\"))
+		return
+	}
+
+	// Data that is not valid base64 clears the selection, as in xterm.
+	value, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		value = nil
+	}
+	for _, name := range sel {
+		t.clipboard[name] = value
+	}
+}
+
+func (s *Server) handleClipboard(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	params := protocol.ClipboardParams{Selection: "c"}
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid clipboard params: %v", err)
+	}
+	if len(params.Selection) != 1 || !strings.Contains("cps01234567", params.Selection) {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid selection %q (use c, p, s or 0-7)", params.Selection)
+	}
+	name := rune(params.Selection[0])
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	if params.Set {
+		sess.Term.clipboard[name] = []byte(params.Text)
+		return protocol.OK(nil)
+	}
+	return protocol.OK(protocol.ClipboardResult{Text: string(sess.Term.clipboard[name])})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strings"
+)
+
+// Emulator is a terminal emulator backend: it interprets program output
+// and holds the resulting screen. Implementations are not safe for
+// concurrent use; the session lock serializes access.
+//
+// DEC modes, the cursor shape and other state that every backend would
+// have to report the same way are tracked separately by termState.
+type Emulator interface {
+	// Write feeds program output to the emulator.
+	Write(b []byte)
+
+	Size() (rows, cols int)
+	Resize(rows, cols int)
+
+	// Cell returns the cell at row, col, which must be on the screen.
+	Cell(row, col int) Cell
+
+	// Cursor returns the cursor position.
+	Cursor() (row, col int)
+
+	// Wrapped reports whether text on row was soft-wrapped onto the next
+	// row at the right margin.
+	Wrapped(row int) bool
+
+	// SetDefaultColors sets the colors of cells that have none of their
+	// own.
+	SetDefaultColors(fg, bg color.RGBA)
+
+	// SetCallbacks registers handlers for events during Write.
+	SetCallbacks(callbacks EmulatorCallbacks)
+
+	// Replies returns and clears what the emulator has written back to the
+	// program since the last call, such as answers to device attribute and
+	// cursor position queries.
+	Replies() []byte
+
+	Close()
+}
+
+// EmulatorCallbacks are called from Emulator.Write. Handlers are optional.
+type EmulatorCallbacks struct {
+	// Bell is called for each BEL outside an escape sequence.
+	Bell func()
+
+	// Scrollback receives each line that scrolls off the top of the main
+	// screen. Backends that cannot report scrollback never call it.
+	Scrollback func(line []Cell)
+
+	// Scroll is called when rows top through bottom of the showing screen
+	// move up by n lines, or down if n is negative.
+	Scroll func(top, bottom, n int)
+}
+
+// Cell is one screen cell.
+type Cell struct {
+	// Text is the character in the cell followed by any combining marks,
+	// or "" if the cell is empty.
+	Text string
+
+	// Width is 1, or 2 for a wide character. The cell to the right of a
+	// wide character has width 0.
+	Width int
+
+	// Fg and Bg are nil for the default colors, and a paletteColor for the
+	// 16 ANSI colors.
+	Fg, Bg color.Color
+
+	Bold, Dim, Italic, Blink, Reverse, Strike bool
+
+	// Underline is 0 (none), 1 (single), 2 (double) or 3 (curly).
+	Underline int
+
+	// Link is the URI of an OSC 8 hyperlink the text was written in.
+	Link string
+}
+
+// paletteColor is one of the 16 ANSI colors, set by index, as the emulator
+// draws it. Captures draw it in the theme's color for the index instead.
+type paletteColor struct {
+	index uint8
+	rgb   color.RGBA
+}
+
+func (c paletteColor) RGBA() (r, g, b, a uint32) {
+	return c.rgb.RGBA()
+}
+
+// parseHyperlink returns the URI set by an OSC 8 sequence, "8;params;URI",
+// which is empty when the sequence ends a link.
+func parseHyperlink(kind byte, data []byte) (uri string, ok bool) {
+	rest, found := strings.CutPrefix(string(data), "8;")
+	if kind != ']' || !found {
+		return "", false
+	}
+	_, uri, ok = strings.Cut(rest, ";")
+	return uri, ok
+}
+
+// maxCharsPerCell matches libvterm's VTERM_MAX_CHARS_PER_CELL: a base
+// character plus combining marks.
+const maxCharsPerCell = 6
+
+// emulators holds the compiled-in backends by name.
+var emulators = map[string]func(rows, cols int) Emulator{
+	"go": newGoEmulator,
+}
+
+// DefaultEmulator is used when Options.Emulator is empty: libvterm when it
+// is compiled in, and the pure-Go emulator otherwise.
+func DefaultEmulator() string {
+	if _, ok := emulators["libvterm"]; ok {
+		return "libvterm"
+	}
+	return "go"
+}
+
+// EmulatorNames lists the compiled-in backends.
+func EmulatorNames() []string {
+	names := make([]string, 0, len(emulators))
+	for name := range emulators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newEmulator(name string, rows, cols int) (Emulator, error) {
+	if name == "" {
+		name = DefaultEmulator()
+	}
+	newFn, ok := emulators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown emulator %q (this build has %s)", name, strings.Join(EmulatorNames(), ", "))
+	}
+	return newFn(rows, cols), nil
+}
@@ -0,0 +1,730 @@
+package server
+
+import (
+	"fmt"
+	"image/color"
+	"slices"
+	"specter/internal/ansi"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+// goEmulator is a pure-Go VT100/xterm emulator covering what TUIs commonly
+// use: cursor movement, scroll regions, insert and delete, erasing, SGR
+// with 256 and 24-bit colors, the alternate screen, autowrap and the DEC
+// line drawing character set. It needs no cgo.
+type goEmulator struct {
+	parser    ansi.Parser
+	callbacks EmulatorCallbacks
+
+	rows, cols int
+	main, alt  *goScreen
+	screen     *goScreen
+
+	row, col    int
+	pendingWrap bool
+	pen         Cell
+	top, bottom int
+
+	autowrap bool
+	insert   bool
+
+	// modes holds the DEC private modes the emulator reports to DECRQM,
+	// including ones only the session acts on, such as bracketed paste.
+	modes map[int]bool
+
+	// charsets holds G0 and G1; shift selects the active one.
+	charsets [2]byte
+	shift    int
+
+	saved goCursor
+
+	utf8 []byte
+	last rune
+
+	// replies holds answers to queries until Replies is called.
+	replies []byte
+}
+
+// goScreen is one screen buffer.
+type goScreen struct {
+	cells   [][]Cell
+	wrapped []bool
+}
+
+// goCursor is the state saved by DECSC.
+type goCursor struct {
+	row, col    int
+	pendingWrap bool
+	pen         Cell
+	charsets    [2]byte
+	shift       int
+}
+
+func newGoEmulator(rows, cols int) Emulator {
+	e := &goEmulator{}
+	e.parser.Print = e.handlePrint
+	e.parser.Control = e.handleControl
+	e.parser.CSI = e.handleCSI
+	e.parser.Escape = e.handleEscape
+	e.parser.String = e.handleString
+	e.resize(rows, cols)
+	e.reset()
+	return e
+}
+
+func newGoScreen(rows, cols int) *goScreen {
+	s := &goScreen{cells: make([][]Cell, rows), wrapped: make([]bool, rows)}
+	for r := range s.cells {
+		s.cells[r] = blankLine(cols, nil)
+	}
+	return s
+}
+
+func blankLine(cols int, bg color.Color) []Cell {
+	line := make([]Cell, cols)
+	for c := range line {
+		line[c] = Cell{Width: 1, Bg: bg}
+	}
+	return line
+}
+
+func (e *goEmulator) reset() {
+	e.main = newGoScreen(e.rows, e.cols)
+	e.alt = newGoScreen(e.rows, e.cols)
+	e.screen = e.main
+	e.row, e.col, e.pendingWrap = 0, 0, false
+	e.pen = Cell{Width: 1}
+	e.top, e.bottom = 0, e.rows-1
+	e.autowrap, e.insert = true, false
+	e.modes = map[int]bool{7: true, 25: true}
+	e.charsets, e.shift = [2]byte{'B', 'B'}, 0
+	e.saved = goCursor{pen: e.pen, charsets: e.charsets}
+}
+
+func (e *goEmulator) Write(b []byte) {
+	e.parser.Feed(b)
+}
+
+func (e *goEmulator) Size() (int, int) {
+	return e.rows, e.cols
+}
+
+func (e *goEmulator) Resize(rows, cols int) {
+	e.resize(rows, cols)
+}
+
+// resize keeps the top-left of both screens, like libvterm without reflow.
+func (e *goEmulator) resize(rows, cols int) {
+	for _, s := range []*goScreen{e.main, e.alt} {
+		if s == nil {
+			continue
+		}
+		cells := make([][]Cell, rows)
+		wrapped := make([]bool, rows)
+		for r := range cells {
+			cells[r] = blankLine(cols, nil)
+			if r < len(s.cells) {
+				copy(cells[r], s.cells[r])
+				wrapped[r] = s.wrapped[r] && len(s.cells[r]) == cols
+			}
+		}
+		s.cells, s.wrapped = cells, wrapped
+	}
+	e.rows, e.cols = rows, cols
+	e.top, e.bottom = 0, rows-1
+	e.row, e.col = min(e.row, rows-1), min(e.col, cols-1)
+	e.pendingWrap = false
+}
+
+func (e *goEmulator) Cell(row, col int) Cell {
+	return e.screen.cells[row][col]
+}
+
+func (e *goEmulator) Cursor() (int, int) {
+	return e.row, e.col
+}
+
+func (e *goEmulator) Wrapped(row int) bool {
+	return e.screen.wrapped[row]
+}
+
+// SetDefaultColors is a no-op: cells without colors of their own report
+// nil, and renderers fill in the theme's defaults.
+func (e *goEmulator) SetDefaultColors(fg, bg color.RGBA) {}
+
+func (e *goEmulator) SetCallbacks(callbacks EmulatorCallbacks) {
+	e.callbacks = callbacks
+}
+
+func (e *goEmulator) Replies() []byte {
+	replies := e.replies
+	e.replies = nil
+	return replies
+}
+
+func (e *goEmulator) Close() {}
+
+// handlePrint collects UTF-8 sequences byte by byte.
+func (e *goEmulator) handlePrint(c byte) {
+	e.utf8 = append(e.utf8, c)
+	if !utf8.FullRune(e.utf8) {
+		return
+	}
+	r, _ := utf8.DecodeRune(e.utf8)
+	e.utf8 = e.utf8[:0]
+	e.print(r)
+}
+
+// decGraphics is the DEC special graphics set selected with ESC ( 0.
+var decGraphics = map[rune]rune{
+	'`': '◆', 'a': '▒', 'f': '°', 'g': '±', 'j': '┘', 'k': '┐', 'l': '┌',
+	'm': '└', 'n': '┼', 'o': '⎺', 'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽',
+	't': '├', 'u': '┤', 'v': '┴', 'w': '┬', 'x': '│', 'y': '≤', 'z': '≥',
+	'{': 'π', '|': '≠', '}': '£', '~': '·',
+}
+
+func (e *goEmulator) print(r rune) {
+	if e.charsets[e.shift] == '0' {
+		if g, ok := decGraphics[r]; ok {
+			r = g
+		}
+	}
+
+	w := runeWidth(r)
+	line := e.screen.cells[e.row]
+
+	if w == 0 {
+		// Combining marks and joiners attach to the previous character.
+		col := e.col - 1
+		if e.pendingWrap {
+			col = e.col
+		}
+		if col >= 0 && line[col].Width == 0 && col > 0 {
+			col--
+		}
+		if col >= 0 && utf8.RuneCountInString(line[col].Text) < maxCharsPerCell && line[col].Text != "" {
+			line[col].Text += string(r)
+		}
+		return
+	}
+	e.last = r
+
+	if e.pendingWrap || (w == 2 && e.col == e.cols-1) {
+		if e.autowrap {
+			e.screen.wrapped[e.row] = true
+			e.col = 0
+			e.lineFeed()
+			line = e.screen.cells[e.row]
+		} else if w == 2 {
+			return
+		}
+		e.pendingWrap = false
+	}
+
+	if e.insert {
+		copy(line[e.col+w:], line[e.col:])
+	}
+	e.clearWide(e.row, e.col)
+	if w == 2 {
+		e.clearWide(e.row, e.col+1)
+	}
+
+	cell := e.pen
+	cell.Text, cell.Width = string(r), w
+	line[e.col] = cell
+	if w == 2 {
+		line[e.col+1] = Cell{Bg: e.pen.Bg}
+	}
+
+	if e.col+w >= e.cols {
+		e.col = e.cols - 1
+		e.pendingWrap = e.autowrap
+	} else {
+		e.col += w
+	}
+}
+
+// clearWide blanks the other half of a wide character that is about to be
+// partly overwritten.
+func (e *goEmulator) clearWide(row, col int) {
+	line := e.screen.cells[row]
+	switch {
+	case line[col].Width == 0 && col > 0:
+		line[col-1] = Cell{Width: 1, Bg: line[col-1].Bg}
+	case line[col].Width == 2 && col+1 < e.cols:
+		line[col+1] = Cell{Width: 1, Bg: line[col+1].Bg}
+	}
+}
+
+func (e *goEmulator) handleControl(c byte) {
+	e.utf8 = e.utf8[:0]
+	switch c {
+	case 0x07:
+		if e.callbacks.Bell != nil {
+			e.callbacks.Bell()
+		}
+	case '\b':
+		e.moveTo(e.row, e.col-1)
+	case '\t':
+		e.moveTo(e.row, min((e.col/8+1)*8, e.cols-1))
+	case '\n', 0x0b, 0x0c:
+		e.pendingWrap = false
+		e.lineFeed()
+	case '\r':
+		e.moveTo(e.row, 0)
+	case 0x0e:
+		e.shift = 1
+	case 0x0f:
+		e.shift = 0
+	}
+}
+
+// moveTo places the cursor, clamped to the screen.
+func (e *goEmulator) moveTo(row, col int) {
+	e.row = max(0, min(row, e.rows-1))
+	e.col = max(0, min(col, e.cols-1))
+	e.pendingWrap = false
+}
+
+// lineFeed moves down a row, scrolling at the bottom of the scroll region.
+func (e *goEmulator) lineFeed() {
+	if e.row == e.bottom {
+		e.scrollUp(e.top, e.bottom, 1)
+	} else if e.row < e.rows-1 {
+		e.row++
+	}
+}
+
+func (e *goEmulator) reverseIndex() {
+	if e.row == e.top {
+		e.scrollDown(e.top, e.bottom, 1)
+	} else if e.row > 0 {
+		e.row--
+	}
+}
+
+// scrollUp moves rows top..bottom up by n, filling with blank lines.
+func (e *goEmulator) scrollUp(top, bottom, n int) {
+	s := e.screen
+	n = min(n, bottom-top+1)
+	if top == 0 && s == e.main && e.callbacks.Scrollback != nil {
+		for r := 0; r < n; r++ {
+			e.callbacks.Scrollback(s.cells[r])
+		}
+	}
+	if e.callbacks.Scroll != nil {
+		e.callbacks.Scroll(top, bottom, n)
+	}
+	copy(s.cells[top:bottom+1], s.cells[top+n:bottom+1])
+	copy(s.wrapped[top:bottom+1], s.wrapped[top+n:bottom+1])
+	for r := bottom - n + 1; r <= bottom; r++ {
+		s.cells[r] = blankLine(e.cols, e.pen.Bg)
+		s.wrapped[r] = false
+	}
+}
+
+// scrollDown moves rows top..bottom down by n, filling with blank lines.
+func (e *goEmulator) scrollDown(top, bottom, n int) {
+	s := e.screen
+	n = min(n, bottom-top+1)
+	if e.callbacks.Scroll != nil {
+		e.callbacks.Scroll(top, bottom, -n)
+	}
+	copy(s.cells[top+n:bottom+1], s.cells[top:bottom+1-n])
+	copy(s.wrapped[top+n:bottom+1], s.wrapped[top:bottom+1-n])
+	for r := top; r < top+n; r++ {
+		s.cells[r] = blankLine(e.cols, e.pen.Bg)
+		s.wrapped[r] = false
+	}
+}
+
+// erase blanks cells from..to (exclusive) on row with the current
+// background.
+func (e *goEmulator) erase(row, from, to int) {
+	line := e.screen.cells[row]
+	for c := max(from, 0); c < min(to, e.cols); c++ {
+		line[c] = Cell{Width: 1, Bg: e.pen.Bg}
+	}
+	if from > 0 && line[from-1].Width == 2 {
+		line[from-1] = Cell{Width: 1, Bg: line[from-1].Bg}
+	}
+	if to < e.cols && line[to].Width == 0 {
+		line[to] = Cell{Width: 1, Bg: line[to].Bg}
+	}
+	if to >= e.cols {
+		e.screen.wrapped[row] = false
+	}
+}
+
+func (e *goEmulator) handleCSI(seq ansi.CSI) {
+	e.utf8 = e.utf8[:0]
+	n := seq.Param(0, 1)
+
+	if seq.Private == '?' {
+		switch {
+		case seq.Final == 'h' || seq.Final == 'l':
+			for _, m := range seq.Params {
+				e.setPrivateMode(m, seq.Final == 'h')
+			}
+		case seq.Final == 'n' && seq.Param(0, 0) == 6: // DECXCPR
+			e.replies = fmt.Appendf(e.replies, "\x1b[?%d;%dR", e.row+1, e.col+1)
+		case seq.Final == 'p' && string(seq.Intermediates) == "$": // DECRQM
+			m := seq.Param(0, 0)
+			e.replies = fmt.Appendf(e.replies, "\x1b[?%d;%d$y", m, modeState(e.modes[m], slices.Contains(goPrivateModes, m)))
+		}
+		return
+	}
+	if seq.Private == 0 && seq.Final == 'p' && string(seq.Intermediates) == "$" { // DECRQM
+		m := seq.Param(0, 0)
+		e.replies = fmt.Appendf(e.replies, "\x1b[%d;%d$y", m, modeState(e.insert, m == 4))
+		return
+	}
+	if seq.Private != 0 || len(seq.Intermediates) > 0 {
+		return
+	}
+
+	switch seq.Final {
+	case '@': // ICH
+		line := e.screen.cells[e.row]
+		n = min(n, e.cols-e.col)
+		copy(line[e.col+n:], line[e.col:])
+		e.erase(e.row, e.col, e.col+n)
+	case 'A': // CUU
+		e.moveTo(max(e.row-n, min(e.top, e.row)), e.col)
+	case 'B', 'e': // CUD, VPR
+		e.moveTo(min(e.row+n, max(e.bottom, e.row)), e.col)
+	case 'C', 'a': // CUF, HPR
+		e.moveTo(e.row, e.col+n)
+	case 'D': // CUB
+		e.moveTo(e.row, e.col-n)
+	case 'E': // CNL
+		e.moveTo(e.row+n, 0)
+	case 'F': // CPL
+		e.moveTo(e.row-n, 0)
+	case 'G', '`': // CHA, HPA
+		e.moveTo(e.row, n-1)
+	case 'H', 'f': // CUP, HVP
+		e.moveTo(n-1, seq.Param(1, 1)-1)
+	case 'd': // VPA
+		e.moveTo(n-1, e.col)
+	case 'I': // CHT
+		e.moveTo(e.row, min((e.col/8+n)*8, e.cols-1))
+	case 'Z': // CBT
+		e.moveTo(e.row, max(((e.col-1)/8-n+1)*8, 0))
+	case 'J': // ED
+		switch seq.Param(0, 0) {
+		case 0:
+			e.erase(e.row, e.col, e.cols)
+			for r := e.row + 1; r < e.rows; r++ {
+				e.erase(r, 0, e.cols)
+			}
+		case 1:
+			for r := 0; r < e.row; r++ {
+				e.erase(r, 0, e.cols)
+			}
+			e.erase(e.row, 0, e.col+1)
+		case 2:
+			for r := 0; r < e.rows; r++ {
+				e.erase(r, 0, e.cols)
+			}
+		}
+		// 3 clears only the scrollback, leaving the screen as it is, as in
+		// xterm and libvterm.
+	case 'K': // EL
+		switch seq.Param(0, 0) {
+		case 0:
+			e.erase(e.row, e.col, e.cols)
+		case 1:
+			e.erase(e.row, 0, e.col+1)
+		case 2:
+			e.erase(e.row, 0, e.cols)
+		}
+	case 'X': // ECH
+		e.erase(e.row, e.col, e.col+n)
+	case 'P': // DCH
+		line := e.screen.cells[e.row]
+		n = min(n, e.cols-e.col)
+		copy(line[e.col:], line[e.col+n:])
+		e.erase(e.row, e.cols-n, e.cols)
+	case 'L': // IL
+		if e.row >= e.top && e.row <= e.bottom {
+			e.scrollDown(e.row, e.bottom, n)
+			e.moveTo(e.row, 0)
+		}
+	case 'M': // DL
+		if e.row >= e.top && e.row <= e.bottom {
+			e.scrollUp(e.row, e.bottom, n)
+			e.moveTo(e.row, 0)
+		}
+	case 'S': // SU
+		e.scrollUp(e.top, e.bottom, n)
+	case 'T': // SD
+		if len(seq.Params) <= 1 {
+			e.scrollDown(e.top, e.bottom, n)
+		}
+	case 'b': // REP
+		if e.last != 0 {
+			for i := 0; i < min(n, e.rows*e.cols); i++ {
+				e.print(e.last)
+			}
+		}
+	case 'h', 'l': // SM, RM
+		for _, m := range seq.Params {
+			if m == 4 {
+				e.insert = seq.Final == 'h'
+			}
+		}
+	case 'm':
+		e.sgr(seq)
+	case 'n': // DSR
+		switch seq.Param(0, 0) {
+		case 5:
+			e.replies = append(e.replies, "\x1b[0n"...)
+		case 6:
+			e.replies = fmt.Appendf(e.replies, "\x1b[%d;%dR", e.row+1, e.col+1)
+		}
+	case 'r': // DECSTBM
+		top, bottom := seq.Param(0, 1)-1, seq.Param(1, e.rows)-1
+		if top < bottom && bottom < e.rows {
+			e.top, e.bottom = top, bottom
+			e.moveTo(0, 0)
+		}
+	case 's': // SCOSC
+		e.saveCursor()
+	case 'u': // SCORC
+		e.restoreCursor()
+	}
+}
+
+// goPrivateModes are the DEC private modes DECRQM reports on: the ones the
+// emulator implements, and the ones the session tracks.
+var goPrivateModes = []int{1, 7, 25, 47, 1000, 1002, 1003, 1004, 1005, 1006, 1015, 1047, 1049, 2004, 2026}
+
+// modeState is the DECRQM answer for a mode: 1 set, 2 reset, or 0 for a
+// mode that is not recognized.
+func modeState(set, known bool) int {
+	switch {
+	case !known:
+		return 0
+	case set:
+		return 1
+	}
+	return 2
+}
+
+func (e *goEmulator) setPrivateMode(mode int, set bool) {
+	if slices.Contains(goPrivateModes, mode) {
+		e.modes[mode] = set
+	}
+	switch mode {
+	case 7:
+		e.autowrap = set
+	case 47, 1047:
+		e.useAltScreen(set)
+	case 1049:
+		if set {
+			e.saveCursor()
+			e.useAltScreen(true)
+		} else {
+			e.useAltScreen(false)
+			e.restoreCursor()
+		}
+	}
+}
+
+// useAltScreen switches screens. The alternate screen starts out blank.
+func (e *goEmulator) useAltScreen(on bool) {
+	if on && e.screen != e.alt {
+		e.alt = newGoScreen(e.rows, e.cols)
+		e.screen = e.alt
+	} else if !on {
+		e.screen = e.main
+	}
+}
+
+func (e *goEmulator) saveCursor() {
+	e.saved = goCursor{e.row, e.col, e.pendingWrap, e.pen, e.charsets, e.shift}
+}
+
+func (e *goEmulator) restoreCursor() {
+	s := e.saved
+	e.moveTo(s.row, s.col)
+	e.pendingWrap, e.pen, e.charsets, e.shift = s.pendingWrap, s.pen, s.charsets, s.shift
+}
+
+func (e *goEmulator) handleEscape(intermediates []byte, final byte) {
+	e.utf8 = e.utf8[:0]
+	if len(intermediates) == 1 && (intermediates[0] == '(' || intermediates[0] == ')') {
+		g := 0
+		if intermediates[0] == ')' {
+			g = 1
+		}
+		e.charsets[g] = final
+		return
+	}
+	if len(intermediates) > 0 {
+		return
+	}
+
+	switch final {
+	case '7': // DECSC
+		e.saveCursor()
+	case '8': // DECRC
+		e.restoreCursor()
+	case 'D': // IND
+		e.pendingWrap = false
+		e.lineFeed()
+	case 'E': // NEL
+		e.pendingWrap = false
+		e.col = 0
+		e.lineFeed()
+	case 'M': // RI
+		e.pendingWrap = false
+		e.reverseIndex()
+	case 'c': // RIS
+		e.reset()
+	}
+}
+
+func (e *goEmulator) handleString(kind byte, data []byte) {
+	e.utf8 = e.utf8[:0]
+	if uri, ok := parseHyperlink(kind, data); ok {
+		e.pen.Link = uri
+	}
+}
+
+func (e *goEmulator) sgr(seq ansi.CSI) {
+	params := seq.Params
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			e.pen = Cell{Width: 1, Link: e.pen.Link}
+		case p == 1:
+			e.pen.Bold = true
+		case p == 2:
+			e.pen.Dim = true
+		case p == 3:
+			e.pen.Italic = true
+		case p == 4:
+			// 4:0 to 4:3 pick no, single, double or curly underline;
+			// dotted and dashed ones are drawn single.
+			e.pen.Underline = 1
+			if sub := seq.Sub(i); len(sub) > 0 && sub[0] <= 3 {
+				e.pen.Underline = sub[0]
+			}
+		case p == 5 || p == 6:
+			e.pen.Blink = true
+		case p == 7:
+			e.pen.Reverse = true
+		case p == 9:
+			e.pen.Strike = true
+		case p == 21:
+			e.pen.Underline = 2
+		case p == 22:
+			e.pen.Bold, e.pen.Dim = false, false
+		case p == 23:
+			e.pen.Italic = false
+		case p == 24:
+			e.pen.Underline = 0
+		case p == 25:
+			e.pen.Blink = false
+		case p == 27:
+			e.pen.Reverse = false
+		case p == 29:
+			e.pen.Strike = false
+		case p >= 30 && p <= 37:
+			e.pen.Fg = indexedColor(p - 30)
+		case p == 39:
+			e.pen.Fg = nil
+		case p >= 40 && p <= 47:
+			e.pen.Bg = indexedColor(p - 40)
+		case p == 49:
+			e.pen.Bg = nil
+		case p >= 90 && p <= 97:
+			e.pen.Fg = indexedColor(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			e.pen.Bg = indexedColor(p - 100 + 8)
+		case p == 38 || p == 48 || p == 58:
+			c, used, ok := sgrColor(params, seq.Sub(i), i)
+			if !ok {
+				return
+			}
+			i += used
+			if c == nil {
+				continue
+			}
+			if p == 38 {
+				e.pen.Fg = c
+			} else if p == 48 {
+				e.pen.Bg = c
+			}
+		}
+	}
+}
+
+// sgrColor reads the extended color that params[i] (38, 48 or 58)
+// introduces, in either form: 38;5;n and 38;2;r;g;b, or with colons as
+// 38:5:n and 38:2:[space]:r:g:b, which sub holds. It returns how many of
+// the following params the color used, and false if the rest of params
+// cannot be read; c is nil for a colon form it does not know.
+func sgrColor(params, sub []int, i int) (c color.Color, used int, ok bool) {
+	args := sub
+	if args == nil {
+		args = params[i+1:]
+	}
+	switch {
+	case len(args) >= 2 && args[0] == 5:
+		c, used = indexedColor(args[1]), 2
+	case len(args) >= 4 && args[0] == 2:
+		rgb := args[1:4]
+		if sub != nil && len(args) >= 5 {
+			// The colon form may carry a color space id first.
+			rgb = args[2:5]
+		}
+		c, used = color.RGBA{uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2]), 255}, 4
+	default:
+		return nil, 0, sub != nil
+	}
+	if sub != nil {
+		used = 0
+	}
+	return c, used, true
+}
+
+// indexedColor resolves a 256-color index the way libvterm does: the 16
+// ANSI colors from its palette, then a 6x6x6 cube and a gray ramp.
+func indexedColor(i int) color.Color {
+	switch {
+	case i < 0 || i > 255:
+		return nil
+	case i < 16:
+		return paletteColor{uint8(i), vtermPalette[i]}
+	case i < 232:
+		ramp := [6]uint8{0x00, 0x5f, 0x87, 0xaf, 0xd7, 0xff}
+		i -= 16
+		return color.RGBA{ramp[i/36], ramp[i/6%6], ramp[i%6], 255}
+	default:
+		g := uint8(8 + 10*(i-232))
+		return color.RGBA{g, g, g, 255}
+	}
+}
+
+// runeWidth returns the number of columns r occupies: 0 for combining
+// marks and format characters such as the zero-width joiner, 2 for East
+// Asian wide and fullwidth characters, which include emoji.
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) || (r >= 0x1160 && r <= 0x11ff) {
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
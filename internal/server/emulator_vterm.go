@@ -0,0 +1,313 @@
+//go:build cgo && !purego
+
+package server
+
+import (
+	"image/color"
+	"specter/internal/ansi"
+
+	"github.com/mattn/go-libvterm"
+)
+
+func init() {
+	emulators["libvterm"] = newVTermEmulator
+}
+
+// vtermEmulator is the libvterm backend.
+type vtermEmulator struct {
+	vt     *vterm.VTerm
+	screen *vterm.Screen
+
+	row, col  int
+	callbacks EmulatorCallbacks
+
+	// libvterm ignores SGR 2 (faint) and OSC 8 hyperlinks, so they are
+	// tracked here: parser finds where they change in each write, and
+	// cells holds them for every cell, following libvterm's damage and
+	// scroll reports.
+	parser     ansi.Parser
+	pen        sidePen
+	penChanges []penChange
+	cells      [][]sidePen
+	painting   sidePen
+}
+
+// sidePen holds the attributes tracked alongside libvterm's own pen.
+type sidePen struct {
+	dim  bool
+	link string
+
+	// fg and bg are 1 plus the index of an ANSI color set by SGR, or 0.
+	// libvterm reports every color as RGB.
+	fg, bg int
+}
+
+// penChange records that the side pen changed with a sequence ending just
+// before offset at.
+type penChange struct {
+	at  int
+	pen sidePen
+}
+
+func newVTermEmulator(rows, cols int) Emulator {
+	vt := vterm.New(rows, cols)
+	vt.SetUTF8(true)
+
+	e := &vtermEmulator{vt: vt, screen: vt.ObtainScreen()}
+	e.resizeCells(rows, cols)
+	e.parser.CSI = e.handleCSI
+	e.parser.Escape = func(intermediates []byte, final byte) {
+		if len(intermediates) == 0 && final == 'c' {
+			e.setPen(sidePen{})
+		}
+	}
+	e.parser.String = func(kind byte, data []byte) {
+		if uri, ok := parseHyperlink(kind, data); ok {
+			pen := e.pen
+			pen.link = uri
+			e.setPen(pen)
+		}
+	}
+
+	e.screen.OnMoveCursor = func(pos, oldpos *vterm.Pos, visible bool) int {
+		e.row, e.col = pos.Row(), pos.Col()
+		return 1
+	}
+	e.screen.OnDamage = func(rect *vterm.Rect) int {
+		e.damage(rect)
+		return 1
+	}
+	e.screen.OnMoveRect = func(dest, src *vterm.Rect) int {
+		e.moveRect(dest, src)
+		return 1
+	}
+	e.screen.OnResize = func(rows, cols int) int {
+		e.resizeCells(rows, cols)
+		return 1
+	}
+	e.screen.OnBell = func() int {
+		if e.callbacks.Bell != nil {
+			e.callbacks.Bell()
+		}
+		return 1
+	}
+	e.screen.Reset(true)
+	return e
+}
+
+// Write splits output where the side pen changes, so cells libvterm
+// reports damaged while writing a piece take that piece's pen.
+func (e *vtermEmulator) Write(b []byte) {
+	e.painting = e.pen
+	e.penChanges = e.penChanges[:0]
+	e.parser.Feed(b)
+
+	start := 0
+	for _, change := range e.penChanges {
+		e.vt.Write(b[start:change.at])
+		e.painting = change.pen
+		start = change.at
+	}
+	e.vt.Write(b[start:])
+}
+
+func (e *vtermEmulator) Size() (int, int) {
+	return e.vt.Size()
+}
+
+func (e *vtermEmulator) Resize(rows, cols int) {
+	e.vt.SetSize(rows, cols)
+}
+
+func (e *vtermEmulator) Cell(row, col int) Cell {
+	cell, err := e.screen.GetCellAt(row, col)
+	if err != nil {
+		return Cell{Width: 1}
+	}
+	// libvterm marks the right half of a wide character with 0xFFFFFFFF.
+	if chars := cell.Chars(); len(chars) > 0 && chars[0] < 0 {
+		return Cell{}
+	}
+
+	// Chars returns one code point per column the cell spans, which drops
+	// combining marks and zero-width joiners; GetChars returns them all.
+	chars := make([]rune, maxCharsPerCell)
+	e.screen.GetChars(&chars, vterm.NewRect(row, row+1, col, col+1))
+
+	var pen sidePen
+	if row < len(e.cells) && col < len(e.cells[row]) {
+		pen = e.cells[row][col]
+	}
+	// Erased cells are painted too, but only text belongs to a link.
+	if len(chars) == 0 {
+		pen.link = ""
+	}
+
+	fg, bg := cell.Fg(), cell.Bg()
+	if pen.fg > 0 {
+		fg = paletteColor{uint8(pen.fg - 1), color.RGBAModel.Convert(fg).(color.RGBA)}
+	}
+	if pen.bg > 0 {
+		bg = paletteColor{uint8(pen.bg - 1), color.RGBAModel.Convert(bg).(color.RGBA)}
+	}
+
+	attrs := cell.Attrs()
+	return Cell{
+		Text:      string(chars),
+		Width:     cell.Width(),
+		Fg:        fg,
+		Bg:        bg,
+		Bold:      attrs.Bold != 0,
+		Dim:       pen.dim,
+		Italic:    attrs.Italic != 0,
+		Blink:     attrs.Blink != 0,
+		Reverse:   attrs.Reverse != 0,
+		Strike:    attrs.Strike != 0,
+		Underline: attrs.Underline,
+		Link:      pen.link,
+	}
+}
+
+func (e *vtermEmulator) Cursor() (int, int) {
+	return e.row, e.col
+}
+
+// Wrapped guesses: go-libvterm does not expose libvterm's line info, so a
+// row is taken to be soft-wrapped when text runs to its last column.
+func (e *vtermEmulator) Wrapped(row int) bool {
+	rows, cols := e.vt.Size()
+	return row+1 < rows && !e.screen.IsEOL(vterm.NewPos(row, cols-1))
+}
+
+func (e *vtermEmulator) SetDefaultColors(fg, bg color.RGBA) {
+	e.vt.ObtainState().SetDefaultColors(fg, bg)
+	e.screen.Reset(true)
+}
+
+// SetCallbacks registers handlers. The bindings do not expose libvterm's
+// scrollback callbacks, so Scrollback is never called.
+func (e *vtermEmulator) SetCallbacks(callbacks EmulatorCallbacks) {
+	e.callbacks = callbacks
+}
+
+// Replies drains libvterm's output buffer, which holds its answers to
+// DA1, DSR, DECRQM and DECRQSS queries.
+func (e *vtermEmulator) Replies() []byte {
+	var replies []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := e.vt.Read(buf)
+		if n <= 0 || err != nil {
+			return replies
+		}
+		replies = append(replies, buf[:n]...)
+	}
+}
+
+func (e *vtermEmulator) Close() {
+	e.vt.Close()
+}
+
+func (e *vtermEmulator) handleCSI(seq ansi.CSI) {
+	if seq.Private == 0 && seq.Final == 'm' && len(seq.Intermediates) == 0 {
+		e.setPen(sgrPen(seq, e.pen))
+	}
+}
+
+// sgrPen applies SGR params to the side pen: faintness, and which colors
+// are ANSI colors set by index.
+func sgrPen(seq ansi.CSI, pen sidePen) sidePen {
+	params := seq.Params
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			pen.dim, pen.fg, pen.bg = false, 0, 0
+		case p == 2:
+			pen.dim = true
+		case p == 22:
+			pen.dim = false
+		case p >= 30 && p <= 37:
+			pen.fg = p - 30 + 1
+		case p == 39:
+			pen.fg = 0
+		case p >= 40 && p <= 47:
+			pen.bg = p - 40 + 1
+		case p == 49:
+			pen.bg = 0
+		case p >= 90 && p <= 97:
+			pen.fg = p - 90 + 8 + 1
+		case p >= 100 && p <= 107:
+			pen.bg = p - 100 + 8 + 1
+		case p == 38 || p == 48 || p == 58:
+			// Extended colors are ANSI colors only as index 0 to 15.
+			index := 0
+			c, used, ok := sgrColor(params, seq.Sub(i), i)
+			if !ok {
+				return pen
+			}
+			i += used
+			if c == nil {
+				continue
+			}
+			if pc, ok := c.(paletteColor); ok {
+				index = int(pc.index) + 1
+			}
+			if p == 38 {
+				pen.fg = index
+			} else if p == 48 {
+				pen.bg = index
+			}
+		}
+	}
+	return pen
+}
+
+func (e *vtermEmulator) setPen(pen sidePen) {
+	if pen != e.pen {
+		e.pen = pen
+		e.penChanges = append(e.penChanges, penChange{at: e.parser.Pos() + 1, pen: pen})
+	}
+}
+
+// resizeCells keeps cells the size of the screen.
+func (e *vtermEmulator) resizeCells(rows, cols int) {
+	cells := make([][]sidePen, rows)
+	for r := range cells {
+		cells[r] = make([]sidePen, cols)
+		if r < len(e.cells) {
+			copy(cells[r], e.cells[r])
+		}
+	}
+	e.cells = cells
+}
+
+// damage marks cells libvterm redrew with the side pen of the output being
+// written.
+func (e *vtermEmulator) damage(rect *vterm.Rect) {
+	for r := rect.StartRow(); r < rect.EndRow() && r < len(e.cells); r++ {
+		for c := rect.StartCol(); c < rect.EndCol() && c < len(e.cells[r]); c++ {
+			e.cells[r][c] = e.painting
+		}
+	}
+}
+
+// moveRect follows libvterm when it scrolls part of the screen, and
+// reports whole rows moving up or down as scrolling.
+func (e *vtermEmulator) moveRect(dest, src *vterm.Rect) {
+	if e.callbacks.Scroll != nil && src.StartCol() == 0 && src.EndCol() == len(e.cells[0]) && src.StartRow() != dest.StartRow() {
+		top := min(src.StartRow(), dest.StartRow())
+		bottom := max(src.EndRow(), dest.EndRow()) - 1
+		e.callbacks.Scroll(top, bottom, src.StartRow()-dest.StartRow())
+	}
+
+	rows := make([][]sidePen, src.EndRow()-src.StartRow())
+	for i := range rows {
+		rows[i] = append([]sidePen(nil), e.cells[src.StartRow()+i][src.StartCol():src.EndCol()]...)
+	}
+	for i, row := range rows {
+		copy(e.cells[dest.StartRow()+i][dest.StartCol():], row)
+	}
+}
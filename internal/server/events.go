@@ -0,0 +1,60 @@
+package server
+
+import (
+	"specter/internal/protocol"
+	"time"
+)
+
+// maxEvents bounds Session.Events, so a program ringing the bell in a loop
+// cannot grow it without limit.
+const maxEvents = 1000
+
+// addEvent records a bell or notification. Emulator and termState
+// callbacks run while output is written, so callers hold the session lock.
+func (sess *Session) addEvent(ev protocol.Event) {
+	ev.Time = time.Now()
+	switch ev.Kind {
+	case protocol.EventBell:
+		sess.Bells++
+	case protocol.EventNotify:
+		sess.Notifications++
+	}
+
+	// Reslicing drops the oldest event without copying; append copies only
+	// the events still held when it outgrows the backing array.
+	sess.Events = append(sess.Events, ev)
+	if len(sess.Events) > maxEvents {
+		sess.Events = sess.Events[1:]
+		sess.EventsDropped++
+	}
+}
+
+// bellSinceInput reports whether the bell rang after the last input.
+// Callers hold the session lock.
+func (sess *Session) bellSinceInput() bool {
+	var since time.Time
+	if n := len(sess.InputHistory); n > 0 {
+		since = sess.InputHistory[n-1].Time
+	}
+	for i := len(sess.Events) - 1; i >= 0 && sess.Events[i].Time.After(since); i-- {
+		if sess.Events[i].Kind == protocol.EventBell {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleEvents(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	return protocol.OK(protocol.EventsResult{
+		Events:  append([]protocol.Event{}, sess.Events...),
+		Dropped: sess.EventsDropped,
+	})
+}
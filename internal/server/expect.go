@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"specter/internal/ansi"
+	"specter/internal/protocol"
+	"time"
+)
+
+// expectText accumulates program output with escape sequences removed, as
+// it arrives, for expect rules to match against. Text up to the last rule
+// match is dropped, as it can never match again.
+type expectText struct {
+	parser ansi.Parser
+	buf    []byte
+}
+
+func newExpectText() *expectText {
+	t := &expectText{}
+	t.parser.Print = func(c byte) { t.buf = append(t.buf, c) }
+	t.parser.Control = func(c byte) {
+		if c == '\n' || c == '\t' {
+			t.buf = append(t.buf, c)
+		}
+	}
+	return t
+}
+
+func (s *Server) handleExpect(client string, req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	params := protocol.ExpectParams{Timeout: protocol.Duration(30 * time.Second)}
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid expect params: %v", err)
+	}
+
+	rules := make([]*regexp.Regexp, len(params.Rules))
+	for i, rule := range params.Rules {
+		re, err := regexp.Compile(rule.On)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBadRequest, "Invalid pattern %q: %v", rule.On, err)
+		}
+		rules[i] = re
+	}
+
+	var until *regexp.Regexp
+	if params.Until != "" {
+		re, err := regexp.Compile(params.Until)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBadRequest, "Invalid pattern %q: %v", params.Until, err)
+		}
+		until = re
+	}
+
+	// Output that was already followed by input or seen by an earlier
+	// expect is skipped, so prompts answered before do not fire again.
+	sess.Mu.Lock()
+	pos := sess.ExpectPos
+	sess.Mu.Unlock()
+	defer func() {
+		sess.Mu.Lock()
+		sess.ExpectPos = max(sess.ExpectPos, pos)
+		sess.Mu.Unlock()
+	}()
+
+	text := newExpectText()
+	result := protocol.ExpectResult{Fired: []protocol.FiredRule{}}
+	deadline := time.Now().Add(time.Duration(params.Timeout))
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		sess.Mu.Lock()
+		var data []byte
+		data, pos = sess.Output.since(pos)
+		exited := sess.Exited
+		var screen string
+		if params.UntilScreen {
+			screen = screenText(readScreen(sess))
+		}
+		sess.Mu.Unlock()
+
+		text.parser.Feed(data)
+
+		// Answer prompts in the order they appeared.
+		consumed := 0
+		for {
+			rule, loc := -1, []int(nil)
+			for i, re := range rules {
+				if m := re.FindIndex(text.buf[consumed:]); m != nil && (loc == nil || m[0] < loc[0]) {
+					rule, loc = i, m
+				}
+			}
+			if rule < 0 {
+				break
+			}
+
+			match := string(text.buf[consumed+loc[0] : consumed+loc[1]])
+			consumed += loc[1]
+
+			send := params.Rules[rule].Send
+			at := time.Now()
+			if _, err := sess.Pty.Write([]byte(send)); err != nil {
+				return expectError(result, protocol.Errorf(protocol.ErrInternal, "Failed to write: %v", err))
+			}
+			sess.recordInput(protocol.InputEvent{Time: at, Client: client, Kind: inputKind(send), Data: []byte(send)})
+
+			result.Fired = append(result.Fired, protocol.FiredRule{
+				Rule:  rule,
+				On:    params.Rules[rule].On,
+				Match: match,
+				Time:  time.Now(),
+			})
+		}
+		text.buf = text.buf[:copy(text.buf, text.buf[consumed:])]
+
+		if until != nil {
+			if m := until.Find(text.buf); m != nil {
+				result.Until = string(m)
+				return protocol.OK(result)
+			}
+			if m := until.FindString(screen); m != "" {
+				result.Until = m
+				return protocol.OK(result)
+			}
+		}
+
+		if exited {
+			if until == nil {
+				return protocol.OK(result)
+			}
+			return expectError(result, protocol.Errorf(protocol.ErrProcessExited, "Process exited before %q appeared", params.Until))
+		}
+
+		if time.Now().After(deadline) {
+			return expectError(result, protocol.Errorf(protocol.ErrTimeout, "Timed out after %v", time.Duration(params.Timeout)))
+		}
+
+		<-ticker.C
+	}
+}
+
+// expectError attaches the rules fired so far to an error response.
+func expectError(result protocol.ExpectResult, resp protocol.Response) protocol.Response {
+	resp.Result, _ = json.Marshal(result)
+	return resp
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+// Font styles index fontSource.fonts.
+const (
+	styleRegular = 0
+	styleBold    = 1
+	styleItalic  = 2
+)
+
+// primaryFonts are used for screenshots, in order of preference, when no
+// --font is given. GoMono is the last resort.
+var primaryFonts = []string{
+	"/usr/share/fonts/TTF/CaskaydiaMonoNerdFont-Regular.ttf",
+	"/usr/share/fonts/TTF/MesloLGS NF Regular.ttf",
+}
+
+// fallbackFonts are tried, in order, for characters the primary font lacks:
+// Nerd Font symbols, then broad monospaced fonts, then emoji and CJK.
+var fallbackFonts = []string{
+	"/usr/share/fonts/TTF/SymbolsNerdFontMono-Regular.ttf",
+	"/usr/share/fonts/truetype/dejavu/DejaVuSansMono.ttf",
+	"/usr/share/fonts/TTF/DejaVuSansMono.ttf",
+	"/usr/share/fonts/truetype/noto/NotoEmoji-Regular.ttf",
+	"/usr/share/fonts/noto/NotoEmoji-Regular.ttf",
+	"/usr/share/fonts/opentype/noto/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/noto-cjk/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/truetype/droid/DroidSansFallbackFull.ttf",
+}
+
+// fontSource is one font in the fallback chain. Fonts without separate
+// style variants use their regular font for every style, with bold
+// synthesized by drawing twice, one pixel apart.
+type fontSource struct {
+	name     string
+	fonts    [4]*opentype.Font
+	fakeBold bool
+}
+
+var (
+	fontMu      sync.Mutex
+	fontSources = map[string]*fontSource{}
+	fontFaces   = map[fontFaceKey]font.Face{}
+	goMono      *fontSource
+)
+
+type fontFaceKey struct {
+	source *fontSource
+	style  int
+	size   float64
+	dpi    float64
+}
+
+func init() {
+	goMono = &fontSource{name: "GoMono"}
+	for style, data := range [4][]byte{gomono.TTF, gomonobold.TTF, gomonoitalic.TTF, gomonobolditalic.TTF} {
+		f, err := opentype.Parse(data)
+		if err != nil {
+			panic(err)
+		}
+		goMono.fonts[style] = f
+	}
+}
+
+// loadFont parses the font file at path, caching the result. Font
+// collections (.ttc) use their first font. Callers hold fontMu.
+func loadFont(path string) (*fontSource, error) {
+	if src, ok := fontSources[path]; ok {
+		return src, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	coll, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	f, err := coll.Font(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	src := &fontSource{name: path, fonts: [4]*opentype.Font{f, f, f, f}, fakeBold: true}
+	fontSources[path] = src
+	return src, nil
+}
+
+// fontChain draws each character from the first font that has it.
+type fontChain struct {
+	sources []*fontSource
+	size    float64
+	dpi     float64
+	buf     sfnt.Buffer
+}
+
+// newFontChain builds the chain for a render: the given fonts, or the
+// default primary font, followed by the system fallbacks that exist and
+// GoMono.
+func newFontChain(paths []string, size, dpi float64) (*fontChain, error) {
+	fontMu.Lock()
+	defer fontMu.Unlock()
+
+	chain := &fontChain{size: size, dpi: dpi}
+	for _, path := range paths {
+		src, err := loadFont(path)
+		if err != nil {
+			return nil, err
+		}
+		chain.sources = append(chain.sources, src)
+	}
+
+	if len(paths) == 0 {
+		for _, path := range primaryFonts {
+			if src, err := loadFont(path); err == nil {
+				chain.sources = append(chain.sources, src)
+				break
+			}
+		}
+	}
+	if len(chain.sources) == 0 {
+		chain.sources = append(chain.sources, goMono)
+	}
+
+	for _, path := range append(append([]string{}, primaryFonts...), fallbackFonts...) {
+		if src, err := loadFont(path); err == nil && !chain.has(src) {
+			chain.sources = append(chain.sources, src)
+		}
+	}
+	if !chain.has(goMono) {
+		chain.sources = append(chain.sources, goMono)
+	}
+	return chain, nil
+}
+
+func (fc *fontChain) has(src *fontSource) bool {
+	for _, s := range fc.sources {
+		if s == src {
+			return true
+		}
+	}
+	return false
+}
+
+// primary returns the regular face of the first font, which sets the cell
+// size and baseline.
+func (fc *fontChain) primary() font.Face {
+	return fc.face(fc.sources[0], styleRegular)
+}
+
+// lookup returns the face to draw r in and whether bold must be faked. ok
+// is false if no font in the chain has r.
+func (fc *fontChain) lookup(r rune, style int) (face font.Face, fakeBold, ok bool) {
+	for _, src := range fc.sources {
+		if i, err := src.fonts[styleRegular].GlyphIndex(&fc.buf, r); err == nil && i != 0 {
+			return fc.face(src, style), src.fakeBold && style&styleBold != 0, true
+		}
+	}
+	return nil, false, false
+}
+
+func (fc *fontChain) face(src *fontSource, style int) font.Face {
+	fontMu.Lock()
+	defer fontMu.Unlock()
+
+	key := fontFaceKey{src, style, fc.size, fc.dpi}
+	if face, ok := fontFaces[key]; ok {
+		return face
+	}
+	face, err := opentype.NewFace(src.fonts[style], &opentype.FaceOptions{
+		Size:    fc.size,
+		DPI:     fc.dpi,
+		Hinting: font.HintingNone,
+	})
+	if err != nil {
+		// The font parsed, so this only fails for invalid sizes, which
+		// callers rule out.
+		panic(err)
+	}
+	fontFaces[key] = face
+	return face
+}
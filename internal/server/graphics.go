@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+	"specter/internal/protocol"
+	"strconv"
+	"strings"
+
+	"github.com/creack/pty"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Pixel size of a cell as reported to programs in the PTY window size,
+// which image programs use to fit pictures to cells. Captures scale images
+// by the ratio of their own cell size to this one.
+const (
+	cellPixelWidth  = 10
+	cellPixelHeight = 20
+)
+
+// Bounds on what programs can make the session hold. maxKittyPayload
+// applies to a whole chunked transmission.
+const (
+	maxImages       = 64
+	maxPlacements   = 256
+	maxKittyPayload = 64 << 20
+	maxKittySize    = 10000
+)
+
+// winsize returns the PTY window size for a screen of rows by cols.
+func winsize(rows, cols int) *pty.Winsize {
+	return &pty.Winsize{
+		Rows: uint16(rows),
+		Cols: uint16(cols),
+		X:    uint16(cols * cellPixelWidth),
+		Y:    uint16(rows * cellPixelHeight),
+	}
+}
+
+// graphics holds the images programs have shown with the kitty graphics
+// protocol and sixel. Placements change in step with the emulator, through
+// termState.act, so that they land at the cursor and scroll with the text
+// around them.
+type graphics struct {
+	// images holds kitty images by id, for placing again with a=p; order
+	// lists the ids oldest first, for evicting past maxImages.
+	images map[int]image.Image
+	order  []int
+
+	placements []placement
+
+	// alt reports whether the alternate screen is showing. Each screen has
+	// its own placements.
+	alt bool
+
+	// loading holds a chunked kitty transmission until its last chunk.
+	loading *kittyCommand
+}
+
+// placement is an image shown on the screen.
+type placement struct {
+	protocol    string
+	id          int
+	placementID int
+	img         image.Image
+
+	// row and col are the top left cell, and rows and cols the cells
+	// covered. row is negative once the image scrolls partly off the top.
+	row, col, rows, cols int
+
+	// width and height are the displayed size, in cell pixels.
+	width, height int
+
+	z   int
+	alt bool
+}
+
+// fit sets the cells p covers from its displayed size.
+func (p *placement) fit() {
+	p.cols = max(1, (p.width+cellPixelWidth-1)/cellPixelWidth)
+	p.rows = max(1, (p.height+cellPixelHeight-1)/cellPixelHeight)
+}
+
+// place adds p at the cursor, replacing a kitty placement with the same
+// image and placement ids.
+func (g *graphics) place(p placement, emu Emulator) {
+	p.row, p.col = emu.Cursor()
+	p.alt = g.alt
+	if p.placementID != 0 {
+		g.remove(func(q placement) bool { return q.id == p.id && q.placementID == p.placementID })
+	}
+	g.placements = append(g.placements, p)
+	if n := len(g.placements); n > maxPlacements {
+		g.placements = append(g.placements[:0], g.placements[n-maxPlacements:]...)
+	}
+}
+
+// store keeps a kitty image for later placements.
+func (g *graphics) store(id int, img image.Image) {
+	if g.images == nil {
+		g.images = make(map[int]image.Image)
+	}
+	if _, ok := g.images[id]; !ok {
+		g.order = append(g.order, id)
+	}
+	g.images[id] = img
+	for len(g.order) > maxImages {
+		delete(g.images, g.order[0])
+		g.order = g.order[1:]
+	}
+}
+
+// remove drops the placements on the showing screen that match.
+func (g *graphics) remove(match func(p placement) bool) {
+	kept := g.placements[:0]
+	for _, p := range g.placements {
+		if p.alt != g.alt || !match(p) {
+			kept = append(kept, p)
+		}
+	}
+	g.placements = kept
+}
+
+// free drops the stored kitty images with the given ids.
+func (g *graphics) free(ids map[int]bool) {
+	order := g.order[:0]
+	for _, id := range g.order {
+		if ids[id] {
+			delete(g.images, id)
+		} else {
+			order = append(order, id)
+		}
+	}
+	g.order = order
+}
+
+// setAlt switches screens. The alternate screen starts out empty, and its
+// images are gone once the program leaves it.
+func (g *graphics) setAlt(alt bool) {
+	g.alt = alt
+	kept := g.placements[:0]
+	for _, p := range g.placements {
+		if !p.alt {
+			kept = append(kept, p)
+		}
+	}
+	g.placements = kept
+}
+
+// reset forgets everything, for RIS.
+func (g *graphics) reset() {
+	*g = graphics{}
+}
+
+// scroll follows the emulator scrolling rows top through bottom up by n
+// lines, or down if n is negative. Images that leave the region are
+// dropped.
+func (g *graphics) scroll(top, bottom, n int) {
+	kept := g.placements[:0]
+	for _, p := range g.placements {
+		if p.alt == g.alt && p.row <= bottom && p.row+p.rows > top {
+			p.row -= n
+			if p.row+p.rows <= top || p.row > bottom {
+				continue
+			}
+		}
+		kept = append(kept, p)
+	}
+	g.placements = kept
+}
+
+// visible returns the placements on the showing screen that overlap
+// region, lowest z first.
+func (g *graphics) visible(region protocol.Region) []placement {
+	var shown []placement
+	for _, p := range g.placements {
+		if p.alt == g.alt && p.row <= region.Bottom && p.row+p.rows > region.Top &&
+			p.col <= region.Right && p.col+p.cols > region.Left {
+			shown = append(shown, p)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool { return shown[i].z < shown[j].z })
+	return shown
+}
+
+// readImages lists the images overlapping region. Callers hold the session
+// lock.
+func readImages(sess *Session, region protocol.Region) []protocol.Image {
+	var images []protocol.Image
+	for _, p := range sess.Term.graphics.visible(region) {
+		b := p.img.Bounds()
+		images = append(images, protocol.Image{
+			Protocol: p.protocol,
+			ID:       p.id,
+			Row:      p.row,
+			Col:      p.col,
+			Rows:     p.rows,
+			Cols:     p.cols,
+			Width:    b.Dx(),
+			Height:   b.Dy(),
+		})
+	}
+	return images
+}
+
+// drawImages composites the images overlapping region onto dst, where the
+// region's top left cell starts at origin and cells are charWidth by
+// charHeight pixels. Callers hold the session lock.
+func drawImages(dst *image.RGBA, sess *Session, region protocol.Region, origin image.Point, charWidth, charHeight int) {
+	rows := region.Bottom - region.Top + 1
+	cols := region.Right - region.Left + 1
+	clip := dst.SubImage(image.Rectangle{Min: origin, Max: origin.Add(image.Pt(cols*charWidth, rows*charHeight))}).(*image.RGBA)
+
+	for _, p := range sess.Term.graphics.visible(region) {
+		x := origin.X + (p.col-region.Left)*charWidth
+		y := origin.Y + (p.row-region.Top)*charHeight
+		r := image.Rect(x, y, x+p.width*charWidth/cellPixelWidth, y+p.height*charHeight/cellPixelHeight)
+		xdraw.ApproxBiLinear.Scale(clip, r, p.img, p.img.Bounds(), xdraw.Over, nil)
+	}
+}
+
+// imageDataURI returns img as a PNG data URI, for HTML and SVG captures.
+func imageDataURI(img image.Image) string {
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// showSixel handles a sixel DCS sequence. The image goes at the cursor,
+// which moves to the line below it.
+func (t *termState) showSixel(data []byte) {
+	img, ok := decodeSixel(data, t.theme.Background)
+	if !ok {
+		return
+	}
+	b := img.Bounds()
+	p := placement{protocol: "sixel", img: img, width: b.Dx(), height: b.Dy()}
+	p.fit()
+	t.act(nil, func(emu Emulator) {
+		t.graphics.place(p, emu)
+		_, col := emu.Cursor()
+		emu.Write([]byte(strings.Repeat("\n", p.rows) + fmt.Sprintf("\x1b[%dG", col+1)))
+	})
+}
+
+// kittyCommand is a kitty graphics protocol command, APC G keys;payload ST,
+// where keys are comma-separated key=value pairs.
+type kittyCommand struct {
+	keys    map[string]string
+	payload []byte
+}
+
+func parseKittyCommand(data []byte) kittyCommand {
+	control, payload, _ := bytes.Cut(data, []byte(";"))
+	cmd := kittyCommand{keys: make(map[string]string), payload: payload}
+	for _, kv := range strings.Split(string(control), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			cmd.keys[k] = v
+		}
+	}
+	return cmd
+}
+
+func (c kittyCommand) str(key, def string) string {
+	if v, ok := c.keys[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (c kittyCommand) int(key string) int {
+	n, _ := strconv.Atoi(c.keys[key])
+	return n
+}
+
+// handleKitty handles the payload of a kitty graphics APC sequence after
+// its G. It transmits (a=t), shows (a=T, a=p), queries (a=q) and deletes
+// (a=d) images, and answers as kitty does: when the command has an image
+// id or number, unless q suppresses it.
+func (t *termState) handleKitty(data []byte) {
+	g := &t.graphics
+	cmd := parseKittyCommand(data)
+
+	// Later chunks carry only m and q; the first chunk's keys apply.
+	if g.loading != nil {
+		g.loading.payload = append(g.loading.payload, cmd.payload...)
+		if len(g.loading.payload) > maxKittyPayload {
+			g.loading = nil
+			return
+		}
+		if cmd.str("m", "0") == "1" {
+			return
+		}
+		cmd, g.loading = *g.loading, nil
+	} else if cmd.str("m", "0") == "1" {
+		cmd.payload = bytes.Clone(cmd.payload)
+		g.loading = &cmd
+		return
+	}
+
+	id := cmd.int("i")
+	switch action := cmd.str("a", "t"); action {
+	case "q":
+		_, err := decodeKitty(cmd)
+		t.act(kittyAnswer(cmd, err), nil)
+	case "t", "T":
+		img, err := decodeKitty(cmd)
+		if err != nil {
+			t.act(kittyAnswer(cmd, err), nil)
+			return
+		}
+		if id == 0 && cmd.int("I") != 0 {
+			id = t.nextImageID()
+			cmd.keys["i"] = strconv.Itoa(id)
+		}
+		if id != 0 {
+			g.store(id, img)
+		}
+		if action == "t" {
+			t.act(kittyAnswer(cmd, nil), nil)
+			return
+		}
+		t.showKitty(cmd, id, img)
+	case "p":
+		img, ok := g.images[id]
+		if !ok {
+			t.act(kittyAnswer(cmd, fmt.Errorf("ENOENT:No image with id %d", id)), nil)
+			return
+		}
+		t.showKitty(cmd, id, img)
+	case "d":
+		t.act(nil, func(emu Emulator) { g.delete(cmd, emu) })
+	}
+}
+
+// nextImageID picks an unused id for an image sent with only a number.
+func (t *termState) nextImageID() int {
+	id := 1 << 24
+	for t.graphics.images[id] != nil {
+		id++
+	}
+	return id
+}
+
+// showKitty places a kitty image at the cursor, sized by the source
+// rectangle (x, y, w, h) and the cells to fill (c, r). Unless C=1, the
+// cursor moves to the cell after the image's last row, as in kitty.
+func (t *termState) showKitty(cmd kittyCommand, id int, img image.Image) {
+	b := img.Bounds()
+	src := image.Rect(cmd.int("x"), cmd.int("y"), b.Dx(), b.Dy())
+	if w := cmd.int("w"); w > 0 {
+		src.Max.X = src.Min.X + w
+	}
+	if h := cmd.int("h"); h > 0 {
+		src.Max.Y = src.Min.Y + h
+	}
+	src = src.Add(b.Min).Intersect(b)
+	if src.Empty() {
+		t.act(kittyAnswer(cmd, fmt.Errorf("EINVAL:Source rectangle is outside the image")), nil)
+		return
+	}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		img = sub.SubImage(src)
+	}
+
+	p := placement{
+		protocol:    "kitty",
+		id:          id,
+		placementID: cmd.int("p"),
+		img:         img,
+		width:       src.Dx(),
+		height:      src.Dy(),
+		z:           cmd.int("z"),
+	}
+	c, r := cmd.int("c"), cmd.int("r")
+	switch {
+	case c > 0 && r > 0:
+		p.width, p.height = c*cellPixelWidth, r*cellPixelHeight
+	case c > 0:
+		p.width, p.height = c*cellPixelWidth, src.Dy()*c*cellPixelWidth/src.Dx()
+	case r > 0:
+		p.width, p.height = src.Dx()*r*cellPixelHeight/src.Dy(), r*cellPixelHeight
+	}
+	p.fit()
+
+	t.act(kittyAnswer(cmd, nil), func(emu Emulator) {
+		t.graphics.place(p, emu)
+		if cmd.str("C", "0") != "1" {
+			emu.Write([]byte(strings.Repeat("\n", p.rows-1) + fmt.Sprintf("\x1b[%dC", p.cols)))
+		}
+	})
+}
+
+// delete handles a=d. The d key picks what to delete: a for all
+// placements, i for those of image i (and placement p, if given), and c
+// for those under the cursor. Upper case also frees the image data.
+func (g *graphics) delete(cmd kittyCommand, emu Emulator) {
+	what := cmd.str("d", "a")
+	var match func(p placement) bool
+	switch strings.ToLower(what) {
+	case "a":
+		match = func(placement) bool { return true }
+	case "i":
+		id, pid := cmd.int("i"), cmd.int("p")
+		match = func(p placement) bool { return p.id == id && (pid == 0 || p.placementID == pid) }
+	case "c":
+		row, col := emu.Cursor()
+		match = func(p placement) bool {
+			return row >= p.row && row < p.row+p.rows && col >= p.col && col < p.col+p.cols
+		}
+	default:
+		return
+	}
+
+	freed := make(map[int]bool)
+	g.remove(func(p placement) bool {
+		if match(p) && p.protocol == "kitty" {
+			freed[p.id] = true
+			return true
+		}
+		return false
+	})
+	if strings.ToUpper(what) == what {
+		if what == "I" {
+			freed[cmd.int("i")] = true
+		}
+		g.free(freed)
+	}
+}
+
+// kittyAnswer is the reply to cmd: OK, or err, which starts with an error
+// code such as EINVAL. Commands without an image id or number get none,
+// and q=1 suppresses OK while q=2 suppresses both.
+func kittyAnswer(cmd kittyCommand, err error) []byte {
+	quiet := cmd.int("q")
+	if cmd.int("i") == 0 && cmd.int("I") == 0 || quiet >= 2 || err == nil && quiet == 1 {
+		return nil
+	}
+	keys := []string{"i=" + strconv.Itoa(cmd.int("i"))}
+	if n := cmd.int("I"); n != 0 {
+		keys = append(keys, "I="+strconv.Itoa(n))
+	}
+	if n := cmd.int("p"); n != 0 {
+		keys = append(keys, "p="+strconv.Itoa(n))
+	}
+	msg := "OK"
+	if err != nil {
+		msg = err.Error()
+	}
+	return []byte("\x1b_G" + strings.Join(keys, ",") + ";" + msg + "\x1b\\")
+}
+
+// decodeKitty decodes the image a transmission carries, optionally
+// zlib-compressed (o=z), as 24-bit RGB (f=24), 32-bit RGBA (f=32) or PNG
+// (f=100). Only direct transmission (t=d) is supported: reading files
+// (t=f, t=t) would let the program have the server open, and remove, any
+// path it can name.
+func decodeKitty(cmd kittyCommand) (image.Image, error) {
+	payload := bytes.TrimRight(cmd.payload, "=")
+	data, err := base64.RawStdEncoding.DecodeString(string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("EINVAL:Invalid base64 payload")
+	}
+
+	if medium := cmd.str("t", "d"); medium != "d" {
+		return nil, fmt.Errorf("EINVAL:Transmission medium %q is not supported", medium)
+	}
+
+	if cmd.str("o", "") == "z" {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("EINVAL:%v", err)
+		}
+		data, err = io.ReadAll(io.LimitReader(zr, maxKittyPayload))
+		if err != nil {
+			return nil, fmt.Errorf("EINVAL:%v", err)
+		}
+	}
+
+	format := cmd.str("f", "32")
+	if format == "100" {
+		// Check the size first: decoding allocates the whole image, under
+		// the session lock.
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("EBADPNG:%v", err)
+		}
+		if cfg.Width > maxKittySize || cfg.Height > maxKittySize {
+			return nil, fmt.Errorf("EINVAL:Invalid image size %dx%d", cfg.Width, cfg.Height)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("EBADPNG:%v", err)
+		}
+		return img, nil
+	}
+
+	bpp := map[string]int{"24": 3, "32": 4}[format]
+	if bpp == 0 {
+		return nil, fmt.Errorf("EINVAL:Unknown format %s", format)
+	}
+	w, h := cmd.int("s"), cmd.int("v")
+	if w <= 0 || h <= 0 || w > maxKittySize || h > maxKittySize {
+		return nil, fmt.Errorf("EINVAL:Invalid image size %dx%d", w, h)
+	}
+	if len(data) != w*h*bpp {
+		return nil, fmt.Errorf("ENODATA:Expected %d bytes of pixel data, got %d", w*h*bpp, len(data))
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		copy(img.Pix[i*4:i*4+3], data[i*bpp:i*bpp+3])
+		img.Pix[i*4+3] = 255
+		if bpp == 4 {
+			img.Pix[i*4+3] = data[i*4+3]
+		}
+	}
+	return img, nil
+}
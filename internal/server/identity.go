@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// terminalIdentity is a terminal that the session presents itself as: in
+// TERM and the environment, and in answers to DA1, DA2, XTVERSION and
+// XTGETTCAP.
+type terminalIdentity struct {
+	term string
+	env  []string
+
+	// da1 and da2 hold the parameters of the primary and secondary device
+	// attributes answers.
+	da1, da2 string
+
+	// version is the XTVERSION answer.
+	version string
+}
+
+// DefaultIdentity keeps TERM=xterm-256color, which every system's terminfo
+// has.
+const DefaultIdentity = "xterm"
+
+var identities = map[string]terminalIdentity{
+	"xterm": {
+		term:    "xterm-256color",
+		env:     []string{"XTERM_VERSION=XTerm(390)"},
+		da1:     "64;1;2;6;9;15;16;17;18;21;22;28",
+		da2:     "41;390;0",
+		version: "XTerm(390)",
+	},
+	"kitty": {
+		term:    "xterm-kitty",
+		env:     []string{"KITTY_WINDOW_ID=1"},
+		da1:     "62;",
+		da2:     "1;4000;35",
+		version: "kitty(0.35.2)",
+	},
+	"tmux": {
+		term:    "tmux-256color",
+		env:     []string{"TERM_PROGRAM=tmux", "TERM_PROGRAM_VERSION=3.4"},
+		da1:     "1;2",
+		da2:     "84;0;0",
+		version: "tmux 3.4",
+	},
+}
+
+// identityVars are the environment variables programs check to tell
+// terminals apart. Values inherited from the terminal specter itself runs
+// in are dropped, so they cannot contradict the identity.
+var identityVars = []string{"TERM", "TERM_PROGRAM", "TERM_PROGRAM_VERSION", "XTERM_VERSION", "KITTY_WINDOW_ID", "TMUX"}
+
+// IdentityNames lists the terminals a session can present itself as.
+func IdentityNames() []string {
+	names := make([]string, 0, len(identities))
+	for name := range identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupIdentity(name string) (terminalIdentity, error) {
+	if name == "" {
+		name = DefaultIdentity
+	}
+	id, ok := identities[name]
+	if !ok {
+		return terminalIdentity{}, fmt.Errorf("unknown identity %q (available: %s)", name, strings.Join(IdentityNames(), ", "))
+	}
+	return id, nil
+}
+
+// environ returns base with the identity's variables in place of any
+// inherited ones.
+func (id terminalIdentity) environ(base []string) []string {
+	var env []string
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(identityVars, name) {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "TERM="+id.term)
+	return append(env, id.env...)
+}
+
+// capability answers an XTGETTCAP query for a terminfo capability. Boolean
+// capabilities have an empty value.
+func (id terminalIdentity) capability(name string) (value string, ok bool) {
+	switch name {
+	case "TN", "name":
+		return id.term, true
+	case "Co", "colors":
+		return "256", true
+	case "RGB":
+		return "", true
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"specter/internal/protocol"
+	"strings"
+)
+
+// readLinks returns the OSC 8 hyperlinks in region, one per run of cells
+// on a row that share a URI. Callers hold the session lock.
+func readLinks(sess *Session, region protocol.Region) []protocol.Link {
+	links := []protocol.Link{}
+	for r := region.Top; r <= region.Bottom; r++ {
+		var cur *protocol.Link
+		var text strings.Builder
+		end := func() {
+			if cur != nil {
+				cur.Text = text.String()
+				links = append(links, *cur)
+				cur = nil
+				text.Reset()
+			}
+		}
+
+		for c := region.Left; c <= region.Right; c++ {
+			cell := sess.Emulator.Cell(r, c)
+			if cell.Width == 0 {
+				// The right half of a wide character extends its link.
+				if cur != nil {
+					cur.EndCol = c + 1
+				}
+				continue
+			}
+			if cur != nil && cell.Link != cur.URI {
+				end()
+			}
+			if cell.Link == "" {
+				continue
+			}
+			if cur == nil {
+				cur = &protocol.Link{Row: r, Col: c, URI: cell.Link}
+			}
+			cur.EndCol = c + 1
+			text.WriteString(cellText(cell))
+		}
+		end()
+	}
+	return links
+}
+
+func (s *Server) handleLinks(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	region, _ := resolveRegion(sess, "")
+	return protocol.OK(protocol.LinksResult{Links: readLinks(sess, region)})
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"image/color"
+	"math"
+	"specter/internal/protocol"
+	"strconv"
+	"strings"
+)
+
+// Cell size of SVG captures, in pixels: a 14px monospace font is about
+// 0.6em wide, with a line height of 1.2em.
+const (
+	svgFontSize   = 14
+	svgCellWidth  = 8.4
+	svgCellHeight = 16.8
+)
+
+// runStyle is everything that decides how a run of cells is drawn.
+type runStyle struct {
+	fg, bg    color.Color
+	bold      bool
+	italic    bool
+	strike    bool
+	underline int
+	link      string
+	cursor    string // cursor shape on this cell, if the cursor is drawn here
+}
+
+// styledRun is a run of cells on one row with the same style. col is
+// relative to the left of the captured region.
+type styledRun struct {
+	col, width int
+	text       string
+	style      runStyle
+}
+
+// styledRuns splits each row of region into runs of cells that share a
+// style, for the markup renderers. Callers hold the session lock.
+func styledRuns(sess *Session, region protocol.Region) [][]styledRun {
+	theme := sess.Theme
+	cursor := sess.cursor()
+
+	var rows [][]styledRun
+	for row := region.Top; row <= region.Bottom; row++ {
+		var runs []styledRun
+		for col := region.Left; col <= region.Right; col++ {
+			cell := sess.Emulator.Cell(row, col)
+			text := cellText(cell)
+			if text == "" {
+				continue
+			}
+
+			fg, bg := theme.cellColors(cell)
+			style := runStyle{
+				fg:        fg,
+				bg:        bg,
+				bold:      cell.Bold,
+				italic:    cell.Italic,
+				strike:    cell.Strike,
+				underline: cell.Underline,
+				link:      safeLink(cell.Link),
+			}
+			if cursor.Visible && cursor.Row == row && cursor.Col == col {
+				style.cursor = cursor.Shape
+				if cursor.Shape == "block" {
+					style.fg, style.bg = bg, theme.Cursor
+				}
+			}
+
+			width := min(cell.Width, region.Right+1-col)
+			if n := len(runs); n > 0 && runs[n-1].style == style && style.cursor == "" {
+				runs[n-1].text += text
+				runs[n-1].width += width
+			} else {
+				runs = append(runs, styledRun{col: col - region.Left, width: width, text: text, style: style})
+			}
+		}
+		rows = append(rows, runs)
+	}
+	return rows
+}
+
+// safeLink returns uri if its scheme is safe to follow from a capture, and
+// "" otherwise, so that links such as javascript: URIs are drawn as plain
+// text.
+func safeLink(uri string) string {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "file", "mailto":
+		return uri
+	}
+	return ""
+}
+
+// svgNumber formats an SVG coordinate without float noise.
+func svgNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+func hexColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// textDecoration returns the CSS text-decoration of a run; links are
+// always underlined.
+func (s runStyle) textDecoration() string {
+	var lines []string
+	if s.underline != 0 || s.link != "" || s.cursor == "underline" {
+		lines = append(lines, "underline")
+	}
+	if s.strike {
+		lines = append(lines, "line-through")
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	if s.underline == 2 {
+		return strings.Join(lines, " ") + " double"
+	}
+	return strings.Join(lines, " ")
+}
+
+// renderHTML returns the region as a standalone HTML page: a <pre> block
+// of styled spans, with OSC 8 hyperlinks as anchors. Callers hold the
+// session lock.
+func renderHTML(sess *Session, region protocol.Region) []byte {
+	theme := sess.Theme
+	title := sess.Term.title
+	if title == "" {
+		title = "specter"
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(&out, "<style>\npre { position: relative; overflow: hidden; margin: 0; padding: 8px; font-family: monospace; line-height: 1.2; color: %s; background: %s; }\na { color: inherit; }\n</style>\n</head>\n<body>\n<pre>",
+		hexColor(theme.Foreground), hexColor(theme.Background))
+
+	for _, runs := range styledRuns(sess, region) {
+		for _, run := range runs {
+			st := run.style
+			var css []string
+			if st.fg != color.Color(theme.Foreground) {
+				css = append(css, "color: "+hexColor(st.fg))
+			}
+			if st.bg != color.Color(theme.Background) {
+				css = append(css, "background: "+hexColor(st.bg))
+			}
+			if st.bold {
+				css = append(css, "font-weight: bold")
+			}
+			if st.italic {
+				css = append(css, "font-style: italic")
+			}
+			if d := st.textDecoration(); d != "" {
+				css = append(css, "text-decoration: "+d)
+			}
+			if st.cursor == "bar" {
+				css = append(css, "box-shadow: inset 2px 0 "+hexColor(theme.Cursor))
+			}
+
+			text := html.EscapeString(run.text)
+			if len(css) > 0 {
+				text = fmt.Sprintf("<span style=\"%s\">%s</span>", strings.Join(css, "; "), text)
+			}
+			if st.link != "" {
+				text = fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(st.link), text)
+			}
+			out.WriteString(text)
+		}
+		out.WriteString("\n")
+	}
+
+	// Images are laid over the text in cell units: ch across, and lines of
+	// 1.2em down.
+	for _, p := range sess.Term.graphics.visible(region) {
+		fmt.Fprintf(&out, "<img src=\"%s\" alt=\"\" style=\"position: absolute; left: calc(8px + %sch); top: calc(8px + %sem); width: %sch; height: %sem\">",
+			imageDataURI(p.img),
+			svgNumber(float64(p.col-region.Left)), svgNumber(float64(p.row-region.Top)*1.2),
+			svgNumber(float64(p.width)/cellPixelWidth), svgNumber(float64(p.height)/cellPixelHeight*1.2))
+	}
+
+	out.WriteString("</pre>\n</body>\n</html>\n")
+	return []byte(out.String())
+}
+
+// renderSVG returns the region as an SVG image with one text element per
+// run, stretched to its cells so columns line up in any monospace font.
+// OSC 8 hyperlinks become anchors. Callers hold the session lock.
+func renderSVG(sess *Session, region protocol.Region) []byte {
+	theme := sess.Theme
+	rows := region.Bottom - region.Top + 1
+	cols := region.Right - region.Left + 1
+	width, height := float64(cols)*svgCellWidth, float64(rows)*svgCellHeight
+
+	var out strings.Builder
+	sw, sh := svgNumber(width), svgNumber(height)
+	fmt.Fprintf(&out, "<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%s\" height=\"%s\" viewBox=\"0 0 %s %s\">\n",
+		sw, sh, sw, sh)
+	if title := sess.Term.title; title != "" {
+		fmt.Fprintf(&out, "<title>%s</title>\n", html.EscapeString(title))
+	}
+	fmt.Fprintf(&out, "<rect width=\"100%%\" height=\"100%%\" fill=\"%s\"/>\n", hexColor(theme.Background))
+	fmt.Fprintf(&out, "<g font-family=\"monospace\" font-size=\"%d\" xml:space=\"preserve\">\n", svgFontSize)
+
+	for r, runs := range styledRuns(sess, region) {
+		y := float64(r) * svgCellHeight
+		for _, run := range runs {
+			st := run.style
+			x, w := float64(run.col)*svgCellWidth, float64(run.width)*svgCellWidth
+
+			if st.bg != color.Color(theme.Background) {
+				fmt.Fprintf(&out, "<rect x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\" fill=\"%s\"/>\n",
+					svgNumber(x), svgNumber(y), svgNumber(w), svgNumber(svgCellHeight), hexColor(st.bg))
+			}
+			if st.cursor == "bar" {
+				fmt.Fprintf(&out, "<rect x=\"%s\" y=\"%s\" width=\"2\" height=\"%s\" fill=\"%s\"/>\n",
+					svgNumber(x), svgNumber(y), svgNumber(svgCellHeight), hexColor(theme.Cursor))
+			}
+			if strings.TrimSpace(run.text) == "" && st.textDecoration() == "" {
+				continue
+			}
+
+			attrs := fmt.Sprintf(" x=\"%s\" y=\"%s\" textLength=\"%s\" lengthAdjust=\"spacingAndGlyphs\" fill=\"%s\"",
+				svgNumber(x), svgNumber(y+svgCellHeight*0.8), svgNumber(w), hexColor(st.fg))
+			if st.bold {
+				attrs += " font-weight=\"bold\""
+			}
+			if st.italic {
+				attrs += " font-style=\"italic\""
+			}
+			if d := st.textDecoration(); d != "" {
+				attrs += " text-decoration=\"" + strings.TrimSuffix(d, " double") + "\""
+			}
+			text := fmt.Sprintf("<text%s>%s</text>", attrs, html.EscapeString(run.text))
+			if st.link != "" {
+				uri := html.EscapeString(st.link)
+				text = fmt.Sprintf("<a href=\"%s\" xlink:href=\"%s\">%s</a>", uri, uri, text)
+			}
+			out.WriteString(text + "\n")
+		}
+	}
+
+	for _, p := range sess.Term.graphics.visible(region) {
+		fmt.Fprintf(&out, "<image x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\" preserveAspectRatio=\"none\" href=\"%[5]s\" xlink:href=\"%[5]s\"/>\n",
+			svgNumber(float64(p.col-region.Left)*svgCellWidth), svgNumber(float64(p.row-region.Top)*svgCellHeight),
+			svgNumber(float64(p.width)*svgCellWidth/cellPixelWidth), svgNumber(float64(p.height)*svgCellHeight/cellPixelHeight),
+			imageDataURI(p.img))
+	}
+
+	out.WriteString("</g>\n</svg>\n")
+	return []byte(out.String())
+}
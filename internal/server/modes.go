@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"specter/internal/protocol"
+	"strings"
+)
+
+// currentModes reports the modes the program has set. Callers hold the
+// session lock.
+func (t *termState) currentModes() protocol.Modes {
+	autowrap, ok := t.modes[modeAutowrap]
+	return protocol.Modes{
+		AltScreen:      t.modes[modeAltScreen] || t.modes[modeAltScreen1047] || t.modes[modeAltScreen1049],
+		AppCursor:      t.modes[modeAppCursor],
+		AppKeypad:      t.appKeypad,
+		BracketedPaste: t.modes[modeBracketedPaste],
+		Focus:          t.modes[modeFocus],
+		CursorVisible:  t.cursorVisible(),
+		Autowrap:       !ok || autowrap,
+		Mouse:          mouseTrackingName(t.mouseTracking()),
+		MouseEncoding:  t.mouseEncoding(),
+	}
+}
+
+// modeValue returns the named mode as wait-for compares it: "on" or "off"
+// for switches, the mode name otherwise.
+func modeValue(m protocol.Modes, name string) (string, error) {
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	switch name {
+	case "altscreen":
+		return onOff(m.AltScreen), nil
+	case "app_cursor":
+		return onOff(m.AppCursor), nil
+	case "app_keypad":
+		return onOff(m.AppKeypad), nil
+	case "bracketed_paste":
+		return onOff(m.BracketedPaste), nil
+	case "focus":
+		return onOff(m.Focus), nil
+	case "cursor_visible":
+		return onOff(m.CursorVisible), nil
+	case "autowrap":
+		return onOff(m.Autowrap), nil
+	case "mouse":
+		return m.Mouse, nil
+	case "mouse_encoding":
+		return m.MouseEncoding, nil
+	}
+	return "", fmt.Errorf("unknown mode %q", name)
+}
+
+// modeChoices lists the values the named mode can have.
+func modeChoices(name string) []string {
+	switch name {
+	case "mouse":
+		return []string{"off", "x10", "normal", "button-event", "any-event"}
+	case "mouse_encoding":
+		return []string{"x10", "utf8", "sgr", "urxvt"}
+	}
+	return []string{"on", "off"}
+}
+
+// parseModeCondition splits a wait-for condition "name=value", checking
+// that the mode exists and can have the value.
+func parseModeCondition(cond string) (name, value string, err error) {
+	name, value, ok := strings.Cut(cond, "=")
+	if !ok || value == "" {
+		return "", "", fmt.Errorf("invalid mode condition %q (use name=value, e.g. altscreen=off)", cond)
+	}
+	if _, err := modeValue(protocol.Modes{}, name); err != nil {
+		return "", "", err
+	}
+	if choices := modeChoices(name); !slices.Contains(choices, value) {
+		return "", "", fmt.Errorf("invalid value %q for %s (use %s)", value, name, strings.Join(choices, ", "))
+	}
+	return name, value, nil
+}
+
+func (s *Server) handleModes(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	return protocol.OK(sess.Term.currentModes())
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"specter/internal/protocol"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Mouse tracking and encoding modes (DEC private modes).
+const (
+	modeMouseX10    = 9
+	modeMouseNormal = 1000
+	modeMouseButton = 1002
+	modeMouseAny    = 1003
+	modeMouseUTF8   = 1005
+	modeMouseSGR    = 1006
+	modeMouseURXVT  = 1015
+)
+
+const (
+	mouseMotionFlag    = 32
+	mouseReleaseButton = 3
+)
+
+var mouseButtons = map[string]int{
+	"left":   0,
+	"middle": 1,
+	"right":  2,
+}
+
+var wheelButtons = map[string]int{
+	"up":    64,
+	"down":  65,
+	"left":  66,
+	"right": 67,
+}
+
+var mouseMods = map[string]int{
+	"S": 4,
+	"M": 8,
+	"C": 16,
+}
+
+// mouseTracking returns the active tracking mode, or 0 if the application
+// has not asked for mouse reports.
+func (t *termState) mouseTracking() int {
+	for _, m := range []int{modeMouseAny, modeMouseButton, modeMouseNormal, modeMouseX10} {
+		if t.modes[m] {
+			return m
+		}
+	}
+	return 0
+}
+
+func (t *termState) mouseEncoding() string {
+	switch {
+	case t.modes[modeMouseSGR]:
+		return "sgr"
+	case t.modes[modeMouseURXVT]:
+		return "urxvt"
+	case t.modes[modeMouseUTF8]:
+		return "utf8"
+	default:
+		return "x10"
+	}
+}
+
+func mouseTrackingName(mode int) string {
+	switch mode {
+	case modeMouseX10:
+		return "x10"
+	case modeMouseNormal:
+		return "normal"
+	case modeMouseButton:
+		return "button-event"
+	case modeMouseAny:
+		return "any-event"
+	}
+	return "off"
+}
+
+// mouseEvent is a single report before encoding. Row and Col are 0-based.
+type mouseEvent struct {
+	button  int // base button code, wheel codes included
+	mods    int
+	motion  bool
+	release bool
+	row     int
+	col     int
+}
+
+// encodeMouse renders ev in the given encoding. It fails if the position
+// cannot be represented, as with the legacy encoding past column 223.
+func encodeMouse(ev mouseEvent, encoding string) (string, error) {
+	cb := ev.button | ev.mods
+	if ev.motion {
+		cb |= mouseMotionFlag
+	}
+	x, y := ev.col+1, ev.row+1
+
+	if encoding == "sgr" {
+		final := 'M'
+		if ev.release {
+			final = 'm'
+		}
+		return fmt.Sprintf("\x1b[<%d;%d;%d%c", cb, x, y, final), nil
+	}
+
+	// The other encodings cannot say which button was released.
+	if ev.release {
+		cb = mouseReleaseButton | ev.mods
+	}
+
+	switch encoding {
+	case "urxvt":
+		return fmt.Sprintf("\x1b[%d;%d;%dM", 32+cb, x, y), nil
+	case "utf8":
+		if 32+x > 2047 || 32+y > 2047 {
+			return "", fmt.Errorf("position %d,%d is out of range for UTF-8 mouse encoding", ev.row, ev.col)
+		}
+		// As in xterm, the button is encoded the same way as the position.
+		buf := []byte("\x1b[M")
+		buf = utf8.AppendRune(buf, rune(32+cb))
+		buf = utf8.AppendRune(buf, rune(32+x))
+		buf = utf8.AppendRune(buf, rune(32+y))
+		return string(buf), nil
+	default:
+		if 32+x > 255 || 32+y > 255 {
+			return "", fmt.Errorf("position %d,%d is out of range for X10 mouse encoding", ev.row, ev.col)
+		}
+		return string([]byte{0x1b, '[', 'M', byte(32 + cb), byte(32 + x), byte(32 + y)}), nil
+	}
+}
+
+// mouseEvents expands an action into the reports the tracking mode allows.
+func mouseEvents(params protocol.MouseParams, tracking int) ([]mouseEvent, error) {
+	mods := 0
+	for _, m := range params.Mods {
+		bit, ok := mouseMods[strings.ToUpper(m)]
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier %q (use C, M or S)", m)
+		}
+		mods |= bit
+	}
+	if tracking == modeMouseX10 {
+		// X10 compatibility mode reports no modifiers.
+		mods = 0
+	}
+
+	buttonName := params.Button
+	if buttonName == "" {
+		buttonName = "left"
+		if params.Action == "scroll" {
+			buttonName = "up"
+		}
+	}
+
+	at := func(row, col int) mouseEvent {
+		return mouseEvent{mods: mods, row: row, col: col}
+	}
+
+	if params.Action == "scroll" {
+		code, ok := wheelButtons[buttonName]
+		if !ok {
+			return nil, fmt.Errorf("unknown scroll direction %q (use up, down, left or right)", buttonName)
+		}
+		ev := at(params.Row, params.Col)
+		ev.button = code
+		return []mouseEvent{ev}, nil
+	}
+
+	button, ok := mouseButtons[buttonName]
+	if !ok {
+		return nil, fmt.Errorf("unknown button %q (use left, middle or right)", buttonName)
+	}
+
+	press := at(params.Row, params.Col)
+	press.button = button
+	release := press
+	release.release = true
+
+	switch params.Action {
+	case "click":
+		if tracking == modeMouseX10 {
+			return []mouseEvent{press}, nil
+		}
+		return []mouseEvent{press, release}, nil
+	case "down":
+		return []mouseEvent{press}, nil
+	case "up":
+		if tracking == modeMouseX10 {
+			return nil, fmt.Errorf("X10 mouse mode does not report releases")
+		}
+		return []mouseEvent{release}, nil
+	case "move":
+		if tracking != modeMouseAny {
+			return nil, fmt.Errorf("mouse mode %s does not report motion without a button held", mouseTrackingName(tracking))
+		}
+		ev := at(params.Row, params.Col)
+		ev.button = mouseReleaseButton
+		ev.motion = true
+		return []mouseEvent{ev}, nil
+	case "drag":
+		if tracking != modeMouseButton && tracking != modeMouseAny {
+			return nil, fmt.Errorf("mouse mode %s does not report drag motion", mouseTrackingName(tracking))
+		}
+		events := []mouseEvent{press}
+		dr, dc := params.ToRow-params.Row, params.ToCol-params.Col
+		steps := max(abs(dr), abs(dc))
+		for i := 1; i <= steps; i++ {
+			ev := at(params.Row+dr*i/steps, params.Col+dc*i/steps)
+			ev.button = button
+			ev.motion = true
+			events = append(events, ev)
+		}
+		end := release
+		end.row, end.col = params.ToRow, params.ToCol
+		return append(events, end), nil
+	}
+
+	return nil, fmt.Errorf("unknown mouse action %q", params.Action)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (s *Server) handleMouse(client string, req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.MouseParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid mouse params: %v", err)
+	}
+
+	sess.Mu.Lock()
+	exited := sess.Exited
+	tracking := sess.Term.mouseTracking()
+	encoding := sess.Term.mouseEncoding()
+	rows, cols := sess.Emulator.Size()
+	sess.Mu.Unlock()
+	if exited {
+		return protocol.Errorf(protocol.ErrProcessExited, "Process has exited")
+	}
+
+	if tracking == 0 {
+		return protocol.Errorf(protocol.ErrBadRequest, "Mouse reporting is off: the application has not enabled any mouse tracking mode")
+	}
+
+	inside := func(row, col int) bool {
+		return row >= 0 && row < rows && col >= 0 && col < cols
+	}
+	if !inside(params.Row, params.Col) || (params.Action == "drag" && !inside(params.ToRow, params.ToCol)) {
+		return protocol.Errorf(protocol.ErrBadRequest, "Position outside the %dx%d screen", rows, cols)
+	}
+
+	events, err := mouseEvents(params, tracking)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "%v", err)
+	}
+
+	var data strings.Builder
+	for _, ev := range events {
+		seq, err := encodeMouse(ev, encoding)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBadRequest, "%v", err)
+		}
+		data.WriteString(seq)
+	}
+
+	at := time.Now()
+	if _, err := sess.Pty.Write([]byte(data.String())); err != nil {
+		return protocol.Errorf(protocol.ErrInternal, "Failed to write: %v", err)
+	}
+
+	sess.recordInput(protocol.InputEvent{Time: at, Client: client, Kind: protocol.InputMouse, Data: []byte(data.String())})
+
+	return protocol.OK(protocol.MouseResult{
+		Tracking: mouseTrackingName(tracking),
+		Encoding: encoding,
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"specter/internal/protocol"
+	"time"
+)
+
+// maxOutputBytes bounds the in-memory output log; the oldest chunks are
+// dropped once it is exceeded. The --output-log file is never truncated.
+const maxOutputBytes = 16 << 20
+
+// outputLog records every chunk read from the PTY along with its offset
+// from session start, measured on the monotonic clock.
+type outputLog struct {
+	start   time.Time
+	chunks  []protocol.OutputChunk
+	size    int
+	total   int64
+	dropped int
+	file    *os.File
+
+	// fileErr is the first error writing to file, after which the file is
+	// closed and no longer written.
+	fileErr error
+}
+
+func newOutputLog(path string) (*outputLog, error) {
+	l := &outputLog{start: time.Now()}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output log: %v", err)
+		}
+		l.file = f
+	}
+	return l, nil
+}
+
+// append records a copy of data. Callers hold the session lock.
+func (l *outputLog) append(data []byte) {
+	chunk := protocol.OutputChunk{
+		Offset: protocol.Duration(time.Since(l.start)),
+		Data:   append([]byte(nil), data...),
+	}
+
+	if l.file != nil {
+		if _, err := fmt.Fprintf(l.file, "%12.6f %q\n", time.Duration(chunk.Offset).Seconds(), chunk.Data); err != nil {
+			l.fileErr = err
+			l.close()
+		}
+	}
+
+	l.chunks = append(l.chunks, chunk)
+	l.size += len(chunk.Data)
+	l.total += int64(len(chunk.Data))
+	for l.size > maxOutputBytes && len(l.chunks) > 1 {
+		l.size -= len(l.chunks[0].Data)
+		l.chunks = l.chunks[1:]
+		l.dropped++
+	}
+}
+
+// since returns the output written after byte offset pos of the whole
+// stream, as far as it is still held in memory, and the offset of its end.
+// Callers hold the session lock.
+func (l *outputLog) since(pos int64) ([]byte, int64) {
+	start := l.total
+	i := len(l.chunks)
+	for i > 0 && start > pos {
+		i--
+		start -= int64(len(l.chunks[i].Data))
+	}
+
+	var out []byte
+	for ; i < len(l.chunks); i++ {
+		data := l.chunks[i].Data
+		if start < pos {
+			data = data[pos-start:]
+		}
+		out = append(out, data...)
+		start += int64(len(l.chunks[i].Data))
+	}
+	return out, l.total
+}
+
+func (l *outputLog) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (s *Server) handleOutput(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	result := protocol.OutputResult{
+		Chunks:  make([]protocol.OutputChunk, len(sess.Output.chunks)),
+		Dropped: sess.Output.dropped,
+	}
+	body := make(chunkPayload, len(sess.Output.chunks))
+	for i, chunk := range sess.Output.chunks {
+		result.Chunks[i] = protocol.OutputChunk{Offset: chunk.Offset, Size: len(chunk.Data)}
+		body[i] = chunk.Data
+	}
+	resp := protocol.OK(result)
+	resp.Payload = body
+	return resp
+}
+
+// chunkPayload streams the output log's chunks as one response body. Chunk
+// data is never modified once appended, so it may be written after the
+// session lock is released.
+type chunkPayload [][]byte
+
+func (p chunkPayload) Size() int64 {
+	var n int64
+	for _, data := range p {
+		n += int64(len(data))
+	}
+	return n
+}
+
+func (p chunkPayload) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, data := range p {
+		m, err := w.Write(data)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
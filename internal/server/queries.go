@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// query is a sequence in program output that asks the terminal for an
+// answer, or that changes state kept in step with the emulator's.
+type query struct {
+	// end is the offset just past the sequence in the write.
+	end int
+
+	// answer is termState's answer, or nil to leave the query to the
+	// emulator.
+	answer []byte
+
+	// apply, if set, runs once the emulator has seen the output up to end,
+	// for changes that depend on its state, such as placing an image at the
+	// cursor.
+	apply func(emu Emulator)
+}
+
+// feed passes program output to termState and the emulator, and returns the
+// answers to queries in it. Answers keep the order of the queries: programs
+// commonly send DA1 last and take anything unanswered before it as
+// unsupported. Callers hold the session lock.
+func (sess *Session) feed(b []byte) []byte {
+	var replies []byte
+	start := 0
+	for _, q := range sess.Term.write(b) {
+		sess.Emulator.Write(b[start:q.end])
+		start = q.end
+		if q.apply != nil {
+			q.apply(sess.Emulator)
+		}
+		// termState's answer replaces any the emulator gave.
+		emulated := sess.Emulator.Replies()
+		if q.answer != nil {
+			replies = append(replies, q.answer...)
+		} else {
+			replies = append(replies, emulated...)
+		}
+	}
+	sess.Emulator.Write(b[start:])
+	return append(replies, sess.Emulator.Replies()...)
+}
+
+// ask records a query ending at the sequence being parsed.
+func (t *termState) ask(answer []byte) {
+	t.act(answer, nil)
+}
+
+// act records a query ending at the sequence being parsed, with a change
+// to apply once the emulator has caught up.
+func (t *termState) act(answer []byte, apply func(emu Emulator)) {
+	t.queries = append(t.queries, query{end: t.parser.Pos() + 1, answer: answer, apply: apply})
+}
+
+// xtermColor formats a color the way xterm answers color queries.
+func xtermColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("rgb:%04x/%04x/%04x", r, g, b)
+}
+
+// queryDynamicColors answers OSC 10, 11 and 12 queries for the default
+// foreground, background and cursor colors from the theme. As in xterm,
+// each further "?" queries the next color, so "10;?;?" asks for both
+// default colors. Programs setting the colors are ignored.
+func (t *termState) queryDynamicColors(code int, arg string) {
+	colors := map[int]color.Color{10: t.theme.Foreground, 11: t.theme.Background, 12: t.theme.Cursor}
+	var answer []byte
+	for _, p := range strings.Split(arg, ";") {
+		if c, ok := colors[code]; ok && p == "?" {
+			answer = fmt.Appendf(answer, "\x1b]%d;%s\x1b\\", code, xtermColor(c))
+		}
+		code++
+	}
+	if answer != nil {
+		t.ask(answer)
+	}
+}
+
+// queryPalette answers OSC 4 queries, "4;index;?" with any number of
+// index and spec pairs, from the theme palette.
+func (t *termState) queryPalette(arg string) {
+	var answer []byte
+	parts := strings.Split(arg, ";")
+	for i := 0; i+1 < len(parts); i += 2 {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 || n > 255 || parts[i+1] != "?" {
+			continue
+		}
+		c := indexedColor(n)
+		if n < 16 {
+			c = t.theme.Palette[n]
+		}
+		answer = fmt.Appendf(answer, "\x1b]4;%d;%s\x1b\\", n, xtermColor(c))
+	}
+	if answer != nil {
+		t.ask(answer)
+	}
+}
+
+// queryCapabilities answers XTGETTCAP, DCS + q Pt ST, where Pt lists
+// hex-encoded terminfo capability names separated by semicolons. Each name
+// gets its own answer, DCS 1 + r name=value ST, or DCS 0 + r ST if the
+// identity does not have it.
+func (t *termState) queryCapabilities(arg string) {
+	var answer []byte
+	for _, encoded := range strings.Split(arg, ";") {
+		name, err := hex.DecodeString(encoded)
+		value, ok := t.identity.capability(string(name))
+		switch {
+		case err != nil || !ok:
+			answer = append(answer, "\x1bP0+r\x1b\\"...)
+		case value == "":
+			answer = fmt.Appendf(answer, "\x1bP1+r%s\x1b\\", encoded)
+		default:
+			answer = fmt.Appendf(answer, "\x1bP1+r%s=%X\x1b\\", encoded, value)
+		}
+	}
+	t.ask(answer)
+}
@@ -2,147 +2,185 @@ package server
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
-	"log"
-	"os"
+	"specter/internal/protocol"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/image/font"
-	"golang.org/x/image/font/gofont/gomono"
-	"golang.org/x/image/font/opentype"
 	"golang.org/x/image/math/fixed"
 )
 
-var (
-	fontFace font.Face
-)
+// renderOptions controls how screenshots are drawn.
+type renderOptions struct {
+	fonts    []string
+	fontSize float64
+	scale    float64
+	padding  int
+	titleBar bool
+}
 
-func init() {
-	// Try to find a Nerd Font on the system
-	fontPaths := []string{
-		"/usr/share/fonts/TTF/CaskaydiaMonoNerdFont-Regular.ttf",
-		"/usr/share/fonts/TTF/MesloLGS NF Regular.ttf",
+// renderOptionsFrom returns the screenshot options in params, with defaults.
+func renderOptionsFrom(params protocol.CaptureParams) (renderOptions, error) {
+	opts := renderOptions{
+		fonts:    params.Fonts,
+		fontSize: params.FontSize,
+		scale:    params.Scale,
+		padding:  params.Padding,
+		titleBar: params.TitleBar,
 	}
-
-	var fontData []byte
-	var err error
-
-	for _, path := range fontPaths {
-		fontData, err = os.ReadFile(path)
-		if err == nil {
-			break
-		}
+	if opts.fontSize == 0 {
+		opts.fontSize = 12
 	}
-
-	if fontData == nil {
-		fontData = gomono.TTF
+	if opts.scale == 0 {
+		opts.scale = 1
+	}
+	if opts.fontSize < 1 || opts.fontSize > 200 {
+		return opts, fmt.Errorf("font size %v is out of range", opts.fontSize)
+	}
+	if opts.scale < 0.25 || opts.scale > 8 {
+		return opts, fmt.Errorf("scale %v is out of range", opts.scale)
+	}
+	if opts.padding < 0 {
+		return opts, fmt.Errorf("padding must not be negative")
 	}
 
-	tt, err := opentype.Parse(fontData)
-	if err != nil {
-		log.Fatalf("Failed to parse font: %v", err)
+	fontMu.Lock()
+	defer fontMu.Unlock()
+	for _, path := range opts.fonts {
+		if _, err := loadFont(path); err != nil {
+			return opts, fmt.Errorf("cannot load font: %v", err)
+		}
 	}
+	return opts, nil
+}
 
-	const size = 12
-	const dpi = 72
-	
-	fontFace, err = opentype.NewFace(tt, &opentype.FaceOptions{
-		Size:    size,
-		DPI:     dpi,
-		Hinting: font.HintingNone,
-	})
+func (s *Server) renderPNG(sess *Session, region protocol.Region, opts renderOptions) ([]byte, error) {
+	rows := region.Bottom - region.Top + 1
+	cols := region.Right - region.Left + 1
+
+	// Scaling renders at a higher DPI, so glyphs stay sharp.
+	fonts, err := newFontChain(opts.fonts, opts.fontSize, 72*opts.scale)
 	if err != nil {
-		log.Fatalf("Failed to create font face: %v", err)
+		return nil, err
 	}
-}
+	px := max(1, int(opts.scale))
+	pad := int(float64(opts.padding) * opts.scale)
 
-func (s *Server) renderPNG(sess *Session) ([]byte, error) {
-	rows, cols := sess.VTerm.Size()
-	
-	// Metrics
-	// GoMono is a monospaced font.
-	// However, opentype.Face doesn't guarantee fixed advance for all glyphs in the interface,
-	// but since it is GoMono, we can measure 'M' or 'W' to get the width.
-	// And height from metrics.
-	
+	// Terminal emulators use a fixed cell size: the advance of 'W' in the
+	// primary font, and its line height with a little leading.
+	fontFace := fonts.primary()
 	metrics := fontFace.Metrics()
-	// Fixed.Int26_6 to int (ceil)
-	// lineHeight := (metrics.Height + metrics.Descent).Ceil() // A bit loose
-	// Actually, terminal emulators usually have a fixed cell size.
-	// Let's measure 'W'
 	adv, ok := fontFace.GlyphAdvance('W')
 	if !ok {
 		adv = fixed.I(7) // fallback
 	}
 	charWidth := adv.Ceil()
-	charHeight := metrics.Height.Ceil() + 2 // Add a little padding/leading
+	charHeight := metrics.Height.Ceil() + 2*px // Add a little padding/leading
+	ascent := metrics.Ascent.Ceil()
 
-	width := cols * charWidth
-	height := rows * charHeight
+	// The title bar is one cell high and spans the padding too.
+	header := 0
+	if opts.titleBar {
+		header = charHeight
+	}
+
+	width := cols*charWidth + 2*pad
+	height := header + rows*charHeight + 2*pad
 
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
 
-	// Default background (black)
-	draw.Draw(img, img.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	theme := sess.Theme
+	draw.Draw(img, img.Bounds(), &image.Uniform{theme.Background}, image.Point{}, draw.Src)
+
+	drawer := font.Drawer{Dst: img}
+	fill := func(x0, y0, x1, y1 int, c color.Color) {
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+
+	if opts.titleBar {
+		fill(0, 0, width, header, theme.Foreground)
+		title := fitTitle(sess.Term.title, width/charWidth)
+		x := (width - stringWidth(title)*charWidth) / 2
+		drawer.Src = &image.Uniform{theme.Background}
+		for _, cell := range splitCells(title) {
+			drawGlyphs(&drawer, fonts, styleBold, cell, fixed.P(x, ascent+px), px)
+			x += stringWidth(cell) * charWidth
+		}
+	}
 
-	drawer := font.Drawer{
-		Dst:  img,
-		Src:  image.White, // Default foreground
-		Face: fontFace,
+	cursor := sess.cursor()
+	cursorAt := func(row, col int) bool {
+		return cursor.Visible && cursor.Row == row && cursor.Col == col
 	}
 
 	for r := 0; r < rows; r++ {
 		for c := 0; c < cols; c++ {
-			cell, err := sess.Screen.GetCellAt(r, c)
-			if err != nil {
+			row, col := region.Top+r, region.Left+c
+			cell := sess.Emulator.Cell(row, col)
+
+			// The right half of a wide character is drawn with its left half.
+			text := cellText(cell)
+			if text == "" {
 				continue
 			}
+			cellWidth := min(cell.Width, cols-c)
+			x0, y0 := pad+c*charWidth, header+pad+r*charHeight
+			x1, y1 := x0+cellWidth*charWidth, y0+charHeight
 
-			// Draw Background
-			bg := cell.Bg()
-			if bg != nil {
-				r1, g1, b1, _ := bg.RGBA()
-				if r1 != 0 || g1 != 0 || b1 != 0 {
-					rect := image.Rect(c*charWidth, r*charHeight, (c+1)*charWidth, (r+1)*charHeight)
-					draw.Draw(img, rect, &image.Uniform{bg}, image.Point{}, draw.Src)
-				}
+			fg, bg := theme.cellColors(cell)
+			if cursorAt(row, col) && cursor.Shape == "block" {
+				fg, bg = bg, theme.Cursor
 			}
 
-			// Draw Character
-			chars := cell.Chars()
-			if len(chars) == 0 {
-				continue // space or empty
+			if bg != color.Color(theme.Background) {
+				fill(x0, y0, x1, y1, bg)
 			}
 
-			// Foreground color
-			fg := cell.Fg()
-			if fg != nil {
+			if text != " " {
+				style := styleRegular
+				if cell.Bold {
+					style |= styleBold
+				}
+				if cell.Italic {
+					style |= styleItalic
+				}
 				drawer.Src = &image.Uniform{fg}
-			} else {
-				drawer.Src = image.White
+
+				// Drawer Dot is the baseline.
+				drawGlyphs(&drawer, fonts, style, text, fixed.P(x0, y0+ascent), px)
 			}
-			
-			// Position
-			// Drawer Dot is the baseline. 
-			x := c * charWidth
-			y := r * charHeight + metrics.Ascent.Ceil()
-			
-			drawer.Dot = fixed.P(x, y)
-			
-			// Only draw characters that exist in the font
-			// Skip characters with missing glyphs to avoid rendering boxes
-			str := string(chars)
-			for _, ch := range str {
-				if _, ok := fontFace.GlyphAdvance(ch); ok {
-					drawer.DrawString(string(ch))
+
+			// Underline values are 1 (single), 2 (double) and 3 (curly,
+			// drawn single).
+			if cell.Underline != 0 {
+				fill(x0, y0+ascent+px, x1, y0+ascent+2*px, fg)
+				if cell.Underline == 2 {
+					fill(x0, y0+ascent+3*px, x1, y0+ascent+4*px, fg)
+				}
+			}
+			if cell.Strike {
+				y := y0 + ascent - ascent/3
+				fill(x0, y, x1, y+px, fg)
+			}
+
+			if cursorAt(row, col) {
+				switch cursor.Shape {
+				case "underline":
+					fill(x0, y1-2*px, x1, y1, theme.Cursor)
+				case "bar":
+					fill(x0, y0, x0+2*px, y1, theme.Cursor)
 				}
-				// If glyph not found, skip it (don't draw a box)
 			}
 		}
 	}
 
+	drawImages(img, sess, region, image.Pt(pad, header+pad), charWidth, charHeight)
+
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, img); err != nil {
 		return nil, err
@@ -150,3 +188,98 @@ func (s *Server) renderPNG(sess *Session) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+// stringWidth returns the number of cells s occupies.
+func stringWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// fitTitle shortens title with an ellipsis to fit in cols cells.
+func fitTitle(title string, cols int) string {
+	if stringWidth(title) <= cols {
+		return title
+	}
+	n := 0
+	for i, r := range title {
+		if n+runeWidth(r) > cols-1 {
+			return title[:i] + "…"
+		}
+		n += runeWidth(r)
+	}
+	return title
+}
+
+// splitCells splits s into the text of each character cell, attaching
+// zero-width characters to the one before.
+func splitCells(s string) []string {
+	var cells []string
+	for i, r := range s {
+		if runeWidth(r) == 0 && len(cells) > 0 {
+			cells[len(cells)-1] += string(r)
+		} else {
+			cells = append(cells, s[i:i+utf8.RuneLen(r)])
+		}
+	}
+	return cells
+}
+
+// drawGlyphs draws text at origin, taking each character from the first
+// font in the chain that has it. Combining marks are drawn over the base
+// character rather than after it, and characters no font has are skipped
+// rather than drawn as boxes.
+func drawGlyphs(drawer *font.Drawer, fonts *fontChain, style int, text string, origin fixed.Point26_6, px int) {
+	for i, ch := range []rune(text) {
+		face, fakeBold, ok := fonts.lookup(ch, style)
+		if !ok {
+			continue
+		}
+		if i == 0 || unicode.Is(unicode.Mn, ch) || unicode.Is(unicode.Me, ch) {
+			drawer.Dot = origin
+		}
+		drawer.Face = face
+		dot := drawer.Dot
+		drawer.DrawString(string(ch))
+		if fakeBold {
+			end := drawer.Dot
+			drawer.Dot = dot.Add(fixed.P(px, 0))
+			drawer.DrawString(string(ch))
+			drawer.Dot = end
+		}
+	}
+}
+
+// cellColors returns the colors a cell is drawn in, after reverse video
+// and faint.
+func (t *Theme) cellColors(cell Cell) (fg, bg color.Color) {
+	fg, bg = t.Foreground, t.Background
+	if cell.Fg != nil {
+		fg = t.color(cell.Fg)
+	}
+	if cell.Bg != nil {
+		bg = t.color(cell.Bg)
+	}
+
+	if cell.Reverse {
+		fg, bg = bg, fg
+	}
+	if cell.Dim {
+		fg = blend(fg, bg)
+	}
+	return fg, bg
+}
+
+// blend returns the color halfway between fg and bg, used for faint text.
+func blend(fg, bg color.Color) color.Color {
+	r1, g1, b1, _ := fg.RGBA()
+	r2, g2, b2, _ := bg.RGBA()
+	return color.RGBA64{
+		R: uint16((r1 + r2) / 2),
+		G: uint16((g1 + g2) / 2),
+		B: uint16((b1 + b2) / 2),
+		A: 0xffff,
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"specter/internal/protocol"
+	"strconv"
+	"strings"
+)
+
+// screenRow is one row of the screen as text along with the screen column
+// of each byte, so matches in the text can be mapped back to cells. cols
+// has one extra entry holding the screen width, so the cell containing
+// byte i ends at the column of the next cell, wide characters included.
+type screenRow struct {
+	text string
+	cols []int
+
+	// wrapped reports that the row continues on the next one; see
+	// Emulator.Wrapped.
+	wrapped bool
+}
+
+// cellText returns the characters in a cell including combining marks, a
+// space if the cell is empty, or "" if it is the right half of a wide
+// character.
+func cellText(cell Cell) string {
+	switch {
+	case cell.Width == 0:
+		return ""
+	case cell.Text == "":
+		return " "
+	}
+	return cell.Text
+}
+
+// readScreen walks the visible cells row by row. Callers hold the session
+// lock.
+func readScreen(sess *Session) []screenRow {
+	rows, cols := sess.Emulator.Size()
+	screen := make([]screenRow, rows)
+
+	for r := 0; r < rows; r++ {
+		var text strings.Builder
+		var colOf []int
+
+		for c := 0; c < cols; c++ {
+			s := cellText(sess.Emulator.Cell(r, c))
+			text.WriteString(s)
+			for i := 0; i < len(s); i++ {
+				colOf = append(colOf, c)
+			}
+		}
+
+		screen[r] = screenRow{text: text.String(), cols: append(colOf, cols)}
+		screen[r].wrapped = r+1 < rows && sess.Emulator.Wrapped(r)
+	}
+
+	return screen
+}
+
+// cursor returns the cursor position from the emulator along with its
+// visibility and shape from termState. Callers hold the session lock.
+func (sess *Session) cursor() protocol.Cursor {
+	row, col := sess.Emulator.Cursor()
+	return protocol.Cursor{
+		Row:     row,
+		Col:     col,
+		Visible: sess.Term.cursorVisible(),
+		Shape:   sess.Term.cursorShape,
+	}
+}
+
+// screenText renders rows as a full-screen text capture: every row padded
+// to the full width and terminated by a newline.
+func screenText(rows []screenRow) string {
+	var out strings.Builder
+	for _, row := range rows {
+		out.WriteString(row.text)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// crop returns the text of the cells from column left to right inclusive.
+// Halves of wide characters cut by the edges become spaces, so the result
+// always spans right-left+1 columns.
+func (row screenRow) crop(left, right int) string {
+	start, end := len(row.text), len(row.text)
+	for i, c := range row.cols[:len(row.text)] {
+		if c >= left && start == len(row.text) {
+			start = i
+		}
+		if row.cellEnd(i) > right+1 {
+			end = i
+			break
+		}
+	}
+	if end < start {
+		end = start
+	}
+
+	lead := min(row.cols[start], right+1) - left
+	trail := right + 1 - max(row.cols[end], left+lead)
+	return strings.Repeat(" ", lead) + row.text[start:end] + strings.Repeat(" ", max(trail, 0))
+}
+
+// cellEnd returns the column just past the cell containing byte i.
+func (row screenRow) cellEnd(i int) int {
+	for j := i + 1; j < len(row.cols); j++ {
+		if row.cols[j] != row.cols[i] {
+			return row.cols[j]
+		}
+	}
+	return row.cols[len(row.cols)-1]
+}
+
+// cropScreen cuts region out of rows, returning one line per row.
+func cropScreen(rows []screenRow, region protocol.Region) []string {
+	lines := make([]string, 0, region.Bottom-region.Top+1)
+	for r := region.Top; r <= region.Bottom; r++ {
+		lines = append(lines, rows[r].crop(region.Left, region.Right))
+	}
+	return lines
+}
+
+// textLine is one line of a text capture and the screen row it starts on.
+type textLine struct {
+	row  int
+	text string
+}
+
+// captureText cuts region out of rows and applies the text capture options.
+func captureText(rows []screenRow, region protocol.Region, params protocol.CaptureParams) string {
+	var lines []textLine
+	for r := region.Top; r <= region.Bottom; r++ {
+		text := rows[r].crop(region.Left, region.Right)
+		if params.WrapJoin && r > region.Top && rows[r-1].wrapped {
+			lines[len(lines)-1].text += text
+			continue
+		}
+		lines = append(lines, textLine{row: r, text: text})
+	}
+
+	if params.Trim {
+		for i := range lines {
+			lines[i].text = strings.TrimRight(lines[i].text, " ")
+		}
+		for len(lines) > 0 && lines[len(lines)-1].text == "" {
+			lines = lines[:len(lines)-1]
+		}
+	}
+
+	if params.Squeeze {
+		blank := func(l textLine) bool { return strings.TrimSpace(l.text) == "" }
+		kept := lines[:0]
+		for i, l := range lines {
+			if i > 0 && blank(l) && blank(lines[i-1]) {
+				continue
+			}
+			kept = append(kept, l)
+		}
+		lines = kept
+	}
+
+	width := len(strconv.Itoa(region.Bottom))
+	var out strings.Builder
+	for _, l := range lines {
+		if params.Numbered {
+			fmt.Fprintf(&out, "%*d| ", width, l.row)
+		}
+		out.WriteString(l.text)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// resolveRegion parses a region spec against the current screen. Callers
+// hold the session lock.
+func resolveRegion(sess *Session, spec string) (protocol.Region, error) {
+	rows, cols := sess.Emulator.Size()
+	full := protocol.Region{Top: 0, Left: 0, Bottom: rows - 1, Right: cols - 1}
+
+	line := func(n int) (protocol.Region, error) {
+		if n < 0 {
+			n += rows
+		}
+		if n < 0 || n >= rows {
+			return protocol.Region{}, fmt.Errorf("line %s is outside the %d-row screen", spec, rows)
+		}
+		return protocol.Region{Top: n, Left: 0, Bottom: n, Right: cols - 1}, nil
+	}
+
+	switch {
+	case spec == "":
+		return full, nil
+	case spec == "last-line":
+		return line(rows - 1)
+	case spec == "cursor-line":
+		return line(sess.cursor().Row)
+	case strings.HasPrefix(spec, "line:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "line:"))
+		if err != nil {
+			return protocol.Region{}, fmt.Errorf("invalid region %q", spec)
+		}
+		return line(n)
+	}
+
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return protocol.Region{}, fmt.Errorf("invalid region %q (use top,left,bottom,right, line:N, last-line or cursor-line)", spec)
+	}
+	var n [4]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return protocol.Region{}, fmt.Errorf("invalid region %q", spec)
+		}
+		n[i] = v
+	}
+
+	region := protocol.Region{Top: n[0], Left: n[1], Bottom: n[2], Right: n[3]}
+	if region.Top < 0 || region.Left < 0 || region.Bottom >= rows || region.Right >= cols ||
+		region.Top > region.Bottom || region.Left > region.Right {
+		return protocol.Region{}, fmt.Errorf("region %q is outside the %dx%d screen", spec, rows, cols)
+	}
+	return region, nil
+}
+
+func (s *Server) handleFind(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.FindParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid find params: %v", err)
+	}
+	if params.Pattern == "" {
+		return protocol.Errorf(protocol.ErrBadRequest, "Empty pattern")
+	}
+
+	expr := params.Pattern
+	if !params.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if params.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid pattern: %v", err)
+	}
+
+	sess.Mu.Lock()
+	rows := readScreen(sess)
+	sess.Mu.Unlock()
+
+	return protocol.OK(protocol.FindResult{Matches: findMatches(rows, re)})
+}
+
+// findMatches returns non-empty matches of re on each row, in reading order.
+func findMatches(rows []screenRow, re *regexp.Regexp) []protocol.Match {
+	matches := []protocol.Match{}
+	for r, row := range rows {
+		for _, loc := range re.FindAllStringIndex(row.text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			matches = append(matches, protocol.Match{
+				Row:    r,
+				Col:    row.cols[loc[0]],
+				EndCol: row.cellEnd(loc[1] - 1),
+				Text:   row.text[loc[0]:loc[1]],
+			})
+		}
+	}
+	return matches
+}
@@ -1,17 +1,21 @@
 package server
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"os"
 	"os/exec"
 	"specter/internal/protocol"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
-	"github.com/mattn/go-libvterm"
 )
 
 const SocketName = ".specter.sock"
@@ -19,21 +23,59 @@ const SocketName = ".specter.sock"
 type Server struct {
 	session  *Session
 	listener net.Listener
+
+	// ops is held shared by ordinary requests and exclusively by batches,
+	// so a batch's steps run without other clients interleaving.
+	ops sync.RWMutex
+}
+
+// Options configure the server and its session at spawn time.
+type Options struct {
+	// OutputLog, if set, is a file that receives every raw chunk read from
+	// the PTY with its timestamp.
+	OutputLog string
+
+	// Theme is a built-in theme name or a theme file; see LoadTheme.
+	Theme string
+
+	// Emulator names the terminal emulator backend; empty selects
+	// DefaultEmulator.
+	Emulator string
+
+	// Identity names the terminal the session presents itself as; empty
+	// selects DefaultIdentity. See IdentityNames.
+	Identity string
 }
 
 type Session struct {
 	Cmd          *exec.Cmd
 	Pty          *os.File
-	VTerm        *vterm.VTerm
-	Screen       *vterm.Screen
+	Emulator     Emulator
 	Mu           sync.Mutex
-	InputHistory []string
+	Args         []string
+	InputHistory []protocol.InputEvent
 	Exited       bool
 	ExitCode     int
 	ExitChan     chan struct{}
+	LastOutput   time.Time
+	Output       *outputLog
+	Term         *termState
+	Theme        *Theme
+
+	// ExpectPos is the output offset up to which expect has nothing left to
+	// answer: the output seen by the last expect, or preceding the last
+	// input.
+	ExpectPos int64
+
+	// Events holds bells and notifications, bounded to maxEvents;
+	// EventsDropped, Bells and Notifications keep counting past that.
+	Events        []protocol.Event
+	EventsDropped int
+	Bells         int
+	Notifications int
 }
 
-func Start(cmd []string) error {
+func Start(cmd []string, opts Options) error {
 	if _, err := os.Stat(SocketName); err == nil {
 		os.Remove(SocketName)
 	}
@@ -47,7 +89,7 @@ func Start(cmd []string) error {
 		listener: listener,
 	}
 
-	if err := s.spawnSession(cmd); err != nil {
+	if err := s.spawnSession(cmd, opts); err != nil {
 		listener.Close()
 		os.Remove(SocketName)
 		return err
@@ -66,32 +108,61 @@ func Start(cmd []string) error {
 	return nil
 }
 
-func (s *Server) spawnSession(cmdArgs []string) error {
+func (s *Server) spawnSession(cmdArgs []string, opts Options) error {
 	if len(cmdArgs) == 0 {
 		return fmt.Errorf("no command specified")
 	}
 
+	theme, err := LoadTheme(opts.Theme)
+	if err != nil {
+		return err
+	}
+	identity, err := lookupIdentity(opts.Identity)
+	if err != nil {
+		return err
+	}
+
+	output, err := newOutputLog(opts.OutputLog)
+	if err != nil {
+		return err
+	}
+
 	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	cmd.Env = identity.environ(os.Environ())
 
 	rows, cols := 30, 100
-	vt := vterm.New(rows, cols)
-	vt.SetUTF8(true)
-	screen := vt.ObtainScreen()
-	screen.Reset(true)
+	emu, err := newEmulator(opts.Emulator, rows, cols)
+	if err != nil {
+		output.close()
+		return err
+	}
+	emu.SetDefaultColors(theme.Foreground, theme.Background)
 
-	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+	ptmx, err := pty.StartWithSize(cmd, winsize(rows, cols))
 	if err != nil {
-		vt.Close()
+		emu.Close()
+		output.close()
 		return fmt.Errorf("failed to start pty: %v", err)
 	}
 
 	sess := &Session{
-		Cmd:      cmd,
-		Pty:      ptmx,
-		VTerm:    vt,
-		Screen:   screen,
-		ExitChan: make(chan struct{}),
+		Args:       cmdArgs,
+		Cmd:        cmd,
+		Pty:        ptmx,
+		Emulator:   emu,
+		ExitChan:   make(chan struct{}),
+		LastOutput: time.Now(),
+		Output:     output,
+		Term:       newTermState(theme, identity),
+		Theme:      theme,
+	}
+
+	emu.SetCallbacks(EmulatorCallbacks{
+		Bell:   func() { sess.addEvent(protocol.Event{Kind: protocol.EventBell}) },
+		Scroll: sess.Term.graphics.scroll,
+	})
+	sess.Term.notify = func(title, body string) {
+		sess.addEvent(protocol.Event{Kind: protocol.EventNotify, Title: title, Body: body})
 	}
 
 	s.session = sess
@@ -104,8 +175,16 @@ func (s *Server) spawnSession(cmdArgs []string) error {
 				break
 			}
 			sess.Mu.Lock()
-			sess.VTerm.Write(buf[:n])
+			replies := sess.feed(buf[:n])
+			sess.Output.append(buf[:n])
+			sess.LastOutput = time.Now()
 			sess.Mu.Unlock()
+
+			// Answers to terminal queries are written outside the lock, as
+			// the write blocks if the program is not reading its input.
+			if len(replies) > 0 {
+				ptmx.Write(replies)
+			}
 		}
 		exitCode := 0
 		if err := cmd.Wait(); err != nil {
@@ -118,6 +197,7 @@ func (s *Server) spawnSession(cmdArgs []string) error {
 		sess.Mu.Lock()
 		sess.Exited = true
 		sess.ExitCode = exitCode
+		sess.Output.close()
 		sess.Mu.Unlock()
 		close(sess.ExitChan)
 	}()
@@ -131,140 +211,589 @@ func (s *Server) handleConnection(conn net.Conn) {
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
 
-	var req protocol.Request
-	if err := decoder.Decode(&req); err != nil {
+	var hello protocol.Request
+	if err := decoder.Decode(&hello); err != nil {
+		return
+	}
+
+	resp, client, framed := s.handleHello(hello)
+	if err := encoder.Encode(resp); err != nil || resp.Status != protocol.StatusOK {
 		return
 	}
 
-	resp := s.processRequest(req)
-	encoder.Encode(resp)
+	if !framed {
+		for {
+			var req protocol.Request
+			if err := decoder.Decode(&req); err != nil {
+				return
+			}
+
+			resp := s.processRequest(client, req)
+			if err := resp.Inline(); err != nil {
+				resp = protocol.Errorf(protocol.ErrInternal, "Failed to read response body: %v", err)
+				resp.ID = req.ID
+			}
+			if err := encoder.Encode(resp); err != nil {
+				return
+			}
+		}
+	}
+
+	r := protocol.FrameReader(decoder, conn)
+	for {
+		var req protocol.Request
+		body, _, err := protocol.ReadFrame(r, &req)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return
+		}
+
+		resp := s.processRequest(client, req)
+		if err := protocol.WriteFrame(conn, resp, resp.Payload); err != nil {
+			return
+		}
+	}
+}
+
+// features lists optional protocol capabilities this server supports,
+// advertised to clients during the hello exchange.
+var features = []string{protocol.FeatureFramed, protocol.FeatureBatch}
+
+// handleHello negotiates the protocol version. It returns the client's name
+// for the input history and whether the connection switches to framed mode
+// after the reply.
+func (s *Server) handleHello(req protocol.Request) (protocol.Response, string, bool) {
+	if req.Op != protocol.OpHello {
+		return protocol.Errorf(protocol.ErrIncompatible, "Client did not negotiate a protocol version (server speaks v%d); upgrade specter", protocol.Version), "", false
+	}
+
+	var hello protocol.Hello
+	if err := req.DecodeParams(&hello); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid hello: %v", err), "", false
+	}
+
+	version := hello.Version
+	if version > protocol.Version {
+		version = protocol.Version
+	}
+	if version < protocol.MinVersion || version < hello.MinVersion {
+		return protocol.Errorf(protocol.ErrIncompatible, "Client speaks protocol v%d-v%d, server speaks v%d-v%d", hello.MinVersion, hello.Version, protocol.MinVersion, protocol.Version), "", false
+	}
+
+	framed := false
+	for _, f := range hello.Features {
+		if f == protocol.FeatureFramed {
+			framed = true
+		}
+	}
+
+	return protocol.OK(protocol.Hello{
+		Version:    version,
+		MinVersion: protocol.MinVersion,
+		Features:   features,
+	}), hello.Client, framed
+}
+
+func (s *Server) processRequest(client string, req protocol.Request) protocol.Response {
+	switch req.Op {
+	case protocol.OpBatch:
+		s.ops.Lock()
+		defer s.ops.Unlock()
+	case protocol.OpWait, protocol.OpKill:
+		// Waiting must not hold up batches, and kill must always get through.
+	default:
+		s.ops.RLock()
+		defer s.ops.RUnlock()
+	}
+
+	resp := s.dispatch(client, req)
+	resp.ID = req.ID
+	return resp
 }
 
-func (s *Server) processRequest(req protocol.Request) protocol.Response {
+func (s *Server) dispatch(client string, req protocol.Request) protocol.Response {
 	switch req.Op {
 	case protocol.OpType:
-		return s.handleType(req)
+		return s.handleType(client, req)
 	case protocol.OpCapture:
 		return s.handleCapture(req)
 	case protocol.OpHistory:
 		return s.handleHistory(req)
 	case protocol.OpWait:
 		return s.handleWait(req)
+	case protocol.OpWaitStable:
+		return s.handleWaitStable(req)
+	case protocol.OpBatch:
+		return s.handleBatch(client, req)
+	case protocol.OpPaste:
+		return s.handlePaste(client, req)
+	case protocol.OpMouse:
+		return s.handleMouse(client, req)
+	case protocol.OpFind:
+		return s.handleFind(req)
+	case protocol.OpExpect:
+		return s.handleExpect(client, req)
+	case protocol.OpStatus:
+		return s.handleStatus(req)
+	case protocol.OpTitle:
+		return s.handleTitle(req)
+	case protocol.OpWaitFor:
+		return s.handleWaitFor(req)
+	case protocol.OpEvents:
+		return s.handleEvents(req)
+	case protocol.OpClipboard:
+		return s.handleClipboard(req)
+	case protocol.OpLinks:
+		return s.handleLinks(req)
+	case protocol.OpModes:
+		return s.handleModes(req)
+	case protocol.OpResize:
+		return s.handleResize(client, req)
+	case protocol.OpSignal:
+		return s.handleSignal(client, req)
+	case protocol.OpOutput:
+		return s.handleOutput(req)
 	case protocol.OpKill:
 		return s.handleKill(req)
 	default:
-		return protocol.Response{Status: "error", Message: "Unknown operation"}
+		return protocol.Errorf(protocol.ErrUnknownOp, "Unknown operation %q", req.Op)
 	}
 }
 
-func (s *Server) handleType(req protocol.Request) protocol.Response {
+func (s *Server) handleType(client string, req protocol.Request) protocol.Response {
 	sess := s.session
 	if sess == nil {
-		return protocol.Response{Status: "error", Message: "No session"}
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.TypeParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid type params: %v", err)
 	}
 
 	sess.Mu.Lock()
 	exited := sess.Exited
 	sess.Mu.Unlock()
 	if exited {
-		return protocol.Response{Status: "error", Message: "Process has exited"}
+		return protocol.Errorf(protocol.ErrProcessExited, "Process has exited")
+	}
+
+	if params.Text == "" {
+		return protocol.OK(nil)
+	}
+
+	if params.Delay < 0 || params.Jitter < 0 {
+		return protocol.Errorf(protocol.ErrBadRequest, "Delay and jitter must not be negative")
 	}
 
-	if len(req.Payload) == 0 {
-		return protocol.Response{Status: "ok"}
+	chunks := []string{params.Text}
+	if params.PerChar || params.Delay > 0 {
+		chunks = keystrokes(params.Text)
+	}
+
+	for i, chunk := range chunks {
+		if i > 0 {
+			time.Sleep(typingDelay(time.Duration(params.Delay), time.Duration(params.Jitter)))
+
+			sess.Mu.Lock()
+			exited := sess.Exited
+			sess.Mu.Unlock()
+			if exited {
+				return protocol.Errorf(protocol.ErrProcessExited, "Process exited after %d of %d keystrokes", i, len(chunks))
+			}
+		}
+
+		at := time.Now()
+		_, err := sess.Pty.Write([]byte(chunk))
+		if err != nil {
+			return protocol.Errorf(protocol.ErrInternal, "Failed to write: %v", err)
+		}
+
+		kind := params.Kind
+		if kind == "" {
+			kind = inputKind(chunk)
+		}
+		sess.recordInput(protocol.InputEvent{Time: at, Client: client, Kind: kind, Data: []byte(chunk)})
+	}
+
+	return protocol.OK(nil)
+}
+
+// keystrokes splits text into what a typist would produce one key at a
+// time: single characters, with escape sequences such as arrow keys kept
+// whole.
+func keystrokes(text string) []string {
+	var keys []string
+	for len(text) > 0 {
+		n := 1
+		if text[0] == 0x1b && len(text) > 1 {
+			n = 2
+			switch text[1] {
+			case '[':
+				for n < len(text) && (text[n] < 0x40 || text[n] > 0x7e) {
+					n++
+				}
+				n = min(n+1, len(text))
+			case 'O':
+				n = min(3, len(text))
+			}
+		} else if _, size := utf8.DecodeRuneInString(text); size > 1 {
+			n = size
+		}
+		keys = append(keys, text[:n])
+		text = text[n:]
+	}
+	return keys
+}
+
+// typingDelay returns delay shifted by a uniformly random amount within
+// ±jitter, never below zero.
+func typingDelay(delay, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		delay += time.Duration(rand.Int64N(int64(2*jitter)+1)) - jitter
+	}
+	return max(delay, 0)
+}
+
+// inputKind classifies typed text for the history: a lone control
+// character or escape sequence is a key press, anything else is text.
+func inputKind(text string) protocol.InputKind {
+	if len(text) == 1 && (text[0] < 0x20 || text[0] == 0x7f) {
+		return protocol.InputKey
+	}
+	if len(text) > 1 && text[0] == 0x1b && !strings.ContainsAny(text[1:], "\x1b\r\n") {
+		return protocol.InputKey
+	}
+	return protocol.InputText
+}
+
+// recordInput appends ev to the input history. Callers that wrote input
+// stamp it with the time they started writing, so output the program
+// produced in response never predates it; other events are stamped with
+// the current time.
+func (sess *Session) recordInput(ev protocol.InputEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	sess.Mu.Lock()
+	sess.InputHistory = append(sess.InputHistory, ev)
+	sess.ExpectPos = sess.Output.total
+	sess.Mu.Unlock()
+}
+
+const (
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+func (s *Server) handlePaste(client string, req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
 	}
 
-	text := req.Payload[0]
-	_, err := sess.Pty.Write([]byte(text))
+	var params protocol.PasteParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid paste params: %v", err)
+	}
+
+	sess.Mu.Lock()
+	exited := sess.Exited
+	bracketed := sess.Term.mode(modeBracketedPaste)
+	sess.Mu.Unlock()
+	if exited {
+		return protocol.Errorf(protocol.ErrProcessExited, "Process has exited")
+	}
+
+	data := params.Text
+	if bracketed {
+		// Like xterm, never let pasted content end the paste early.
+		data = pasteStart + strings.ReplaceAll(data, pasteEnd, "") + pasteEnd
+	}
+
+	at := time.Now()
+	if _, err := sess.Pty.Write([]byte(data)); err != nil {
+		return protocol.Errorf(protocol.ErrInternal, "Failed to write: %v", err)
+	}
+
+	sess.recordInput(protocol.InputEvent{Time: at, Client: client, Kind: protocol.InputPaste, Data: []byte(data)})
+
+	return protocol.OK(protocol.PasteResult{Bracketed: bracketed})
+}
+
+func (s *Server) handleResize(client string, req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.ResizeParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid resize params: %v", err)
+	}
+	if params.Rows <= 0 || params.Cols <= 0 || params.Rows > 1000 || params.Cols > 1000 {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid size %dx%d", params.Rows, params.Cols)
+	}
+
+	sess.Mu.Lock()
+	if sess.Exited {
+		sess.Mu.Unlock()
+		return protocol.Errorf(protocol.ErrProcessExited, "Process has exited")
+	}
+	sess.Emulator.Resize(params.Rows, params.Cols)
+	err := pty.Setsize(sess.Pty, winsize(params.Rows, params.Cols))
+	sess.Mu.Unlock()
 	if err != nil {
-		return protocol.Response{Status: "error", Message: fmt.Sprintf("Failed to write: %v", err)}
+		return protocol.Errorf(protocol.ErrInternal, "Failed to resize: %v", err)
+	}
+
+	sess.recordInput(protocol.InputEvent{Client: client, Kind: protocol.InputResize, Rows: params.Rows, Cols: params.Cols})
+
+	return protocol.OK(nil)
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+func (s *Server) handleSignal(client string, req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.SignalParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid signal params: %v", err)
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(params.Signal), "SIG")
+	sig, ok := signals[name]
+	if !ok {
+		return protocol.Errorf(protocol.ErrBadRequest, "Unknown signal %q", params.Signal)
 	}
 
 	sess.Mu.Lock()
-	sess.InputHistory = append(sess.InputHistory, text)
+	exited := sess.Exited
 	sess.Mu.Unlock()
+	if exited {
+		return protocol.Errorf(protocol.ErrProcessExited, "Process has exited")
+	}
+
+	if err := sess.Cmd.Process.Signal(sig); err != nil {
+		return protocol.Errorf(protocol.ErrInternal, "Failed to signal: %v", err)
+	}
 
-	return protocol.Response{Status: "ok"}
+	sess.recordInput(protocol.InputEvent{Client: client, Kind: protocol.InputSignal, Signal: name})
+
+	return protocol.OK(nil)
 }
 
 func (s *Server) handleCapture(req protocol.Request) protocol.Response {
 	sess := s.session
 	if sess == nil {
-		return protocol.Response{Status: "error", Message: "No session"}
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	params := protocol.CaptureParams{Format: "text"}
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid capture params: %v", err)
 	}
 
 	sess.Mu.Lock()
 	defer sess.Mu.Unlock()
 
-	format := "text"
-	if req.Options != nil {
-		if f, ok := req.Options["format"]; ok {
-			format = f
-		}
+	region, err := resolveRegion(sess, params.Region)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "%v", err)
+	}
+
+	if params.Format != "png" && (len(params.Fonts) > 0 || params.FontSize != 0 || params.Scale != 0 || params.Padding != 0 || params.TitleBar) {
+		return protocol.Errorf(protocol.ErrBadRequest, "Font, font size, scale, padding and title bar apply to PNG captures only")
 	}
 
-	if format == "png" {
-		pngBytes, err := s.renderPNG(sess)
+	if params.Format == "" || params.Format == "text" {
+		return protocol.OK(protocol.CaptureResult{Text: captureText(readScreen(sess), region, params)})
+	}
+	if params.Trim || params.Squeeze || params.Numbered || params.WrapJoin {
+		return protocol.Errorf(protocol.ErrBadRequest, "Trim, squeeze, numbered and wrap-join apply to text captures only")
+	}
+
+	switch params.Format {
+	case "json":
+		rows, cols := sess.Emulator.Size()
+		return protocol.OK(protocol.CaptureResult{Screen: &protocol.Screen{
+			Rows:     rows,
+			Cols:     cols,
+			Region:   region,
+			Cursor:   sess.cursor(),
+			Title:    sess.Term.title,
+			IconName: sess.Term.iconName,
+			Modes:    sess.Term.currentModes(),
+			Lines:    cropScreen(readScreen(sess), region),
+			Links:    readLinks(sess, region),
+			Images:   readImages(sess, region),
+		}})
+	case "png":
+		opts, err := renderOptionsFrom(params)
 		if err != nil {
-			return protocol.Response{Status: "error", Message: fmt.Sprintf("Failed to render PNG: %v", err)}
+			return protocol.Errorf(protocol.ErrBadRequest, "%v", err)
 		}
-		encoded := base64.StdEncoding.EncodeToString(pngBytes)
-		return protocol.Response{Status: "ok", Data: encoded}
-	}
-
-	rows, cols := sess.VTerm.Size()
-	var output string
-
-	for r := 0; r < rows; r++ {
-		for c := 0; c < cols; c++ {
-			cell, err := sess.Screen.GetCellAt(r, c)
-			if err == nil {
-				chars := cell.Chars()
-				if len(chars) > 0 {
-					output += string(chars)
-				} else {
-					output += " "
-				}
-			} else {
-				output += " "
-			}
+		pngBytes, err := s.renderPNG(sess, region, opts)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrInternal, "Failed to render PNG: %v", err)
+		}
+		resp := protocol.OK(protocol.CaptureResult{})
+		resp.Payload = protocol.Bytes(pngBytes)
+		return resp
+	case "html", "svg":
+		resp := protocol.OK(protocol.CaptureResult{})
+		if params.Format == "html" {
+			resp.Payload = protocol.Bytes(renderHTML(sess, region))
+		} else {
+			resp.Payload = protocol.Bytes(renderSVG(sess, region))
 		}
-		output += "\n"
+		return resp
+	default:
+		return protocol.Errorf(protocol.ErrBadRequest, "Unknown capture format %q", params.Format)
 	}
-
-	return protocol.Response{Status: "ok", Data: output}
 }
 
 func (s *Server) handleHistory(req protocol.Request) protocol.Response {
 	sess := s.session
 	if sess == nil {
-		return protocol.Response{Status: "error", Message: "No session"}
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
 	}
 
 	sess.Mu.Lock()
 	defer sess.Mu.Unlock()
 
-	bytes, err := json.Marshal(sess.InputHistory)
-	if err != nil {
-		return protocol.Response{Status: "error", Message: fmt.Sprintf("Failed to marshal history: %v", err)}
-	}
-
-	return protocol.Response{Status: "ok", Data: string(bytes)}
+	return protocol.OK(protocol.HistoryResult{
+		Command: sess.Args,
+		Events:  append([]protocol.InputEvent{}, sess.InputHistory...),
+	})
 }
 
 func (s *Server) handleWait(req protocol.Request) protocol.Response {
 	sess := s.session
 	if sess == nil {
-		return protocol.Response{Status: "error", Message: "No session"}
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	var params protocol.WaitParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid wait params: %v", err)
 	}
 
-	<-sess.ExitChan
+	var timeout <-chan time.Time
+	if params.Timeout > 0 {
+		timeout = time.After(time.Duration(params.Timeout))
+	}
+
+	select {
+	case <-sess.ExitChan:
+	case <-timeout:
+		return protocol.Errorf(protocol.ErrTimeout, "Process still running after %v", time.Duration(params.Timeout))
+	}
 
 	sess.Mu.Lock()
 	exitCode := sess.ExitCode
 	sess.Mu.Unlock()
 
-	return protocol.Response{Status: "ok", Data: fmt.Sprintf("%d", exitCode)}
+	return protocol.OK(protocol.WaitResult{ExitCode: exitCode})
+}
+
+func (s *Server) handleWaitStable(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	params := protocol.WaitStableParams{
+		Quiet:   protocol.Duration(300 * time.Millisecond),
+		Timeout: protocol.Duration(10 * time.Second),
+	}
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid wait-stable params: %v", err)
+	}
+
+	quiet := time.Duration(params.Quiet)
+	deadline := time.Now().Add(time.Duration(params.Timeout))
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		sess.Mu.Lock()
+		idle := time.Since(sess.LastOutput)
+		sess.Mu.Unlock()
+
+		if idle >= quiet {
+			return protocol.OK(nil)
+		}
+		if time.Now().After(deadline) {
+			return protocol.Errorf(protocol.ErrTimeout, "Output did not settle within %v", time.Duration(params.Timeout))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sess.ExitChan:
+			return protocol.OK(nil)
+		}
+	}
+}
+
+func (s *Server) handleBatch(client string, req protocol.Request) protocol.Response {
+	var params protocol.BatchParams
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid batch params: %v", err)
+	}
+
+	for _, step := range params.Steps {
+		if step.Op == protocol.OpBatch || step.Op == protocol.OpHello {
+			return protocol.Errorf(protocol.ErrBadRequest, "Operation %q is not allowed in a batch", step.Op)
+		}
+		// Other clients are held off for the whole batch, so a step may not
+		// block indefinitely. The other waiting steps default to a timeout.
+		if step.Op == protocol.OpWait {
+			var wait protocol.WaitParams
+			if err := step.DecodeParams(&wait); err != nil {
+				return protocol.Errorf(protocol.ErrBadRequest, "Invalid wait params: %v", err)
+			}
+			if wait.Timeout <= 0 {
+				return protocol.Errorf(protocol.ErrBadRequest, "A wait step in a batch needs a timeout")
+			}
+		}
+	}
+
+	result := protocol.BatchResult{Steps: []protocol.Response{}}
+	for _, step := range params.Steps {
+		resp := s.dispatch(client, step)
+		if err := resp.Inline(); err != nil {
+			resp = protocol.Errorf(protocol.ErrInternal, "Failed to read response body: %v", err)
+		}
+		resp.ID = step.ID
+		result.Steps = append(result.Steps, resp)
+
+		if resp.Status != protocol.StatusOK && !params.ContinueOnError {
+			break
+		}
+	}
+
+	return protocol.OK(result)
 }
 
 func (s *Server) handleKill(req protocol.Request) protocol.Response {
@@ -275,7 +804,7 @@ func (s *Server) handleKill(req protocol.Request) protocol.Response {
 			sess.Cmd.Process.Kill()
 		}
 		sess.Pty.Close()
-		sess.VTerm.Close()
+		sess.Emulator.Close()
 		sess.Mu.Unlock()
 	}
 
@@ -284,5 +813,5 @@ func (s *Server) handleKill(req protocol.Request) protocol.Response {
 		os.Remove(SocketName)
 	}()
 
-	return protocol.Response{Status: "ok", Message: "Server shutting down"}
+	return protocol.OK(protocol.KillResult{})
 }
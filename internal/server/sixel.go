@@ -0,0 +1,219 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// maxSixelSize bounds each side of a sixel image, in pixels.
+const maxSixelSize = 4096
+
+// sixelPalette is the VT340's default palette for the first 16 color
+// registers; the rest start black.
+var sixelPalette = [16]color.RGBA{
+	{0, 0, 0, 255}, {51, 51, 204, 255}, {204, 36, 36, 255}, {51, 204, 51, 255},
+	{204, 51, 204, 255}, {51, 204, 204, 255}, {204, 204, 51, 255}, {120, 120, 120, 255},
+	{69, 69, 69, 255}, {87, 87, 153, 255}, {153, 69, 69, 255}, {87, 153, 87, 255},
+	{153, 87, 153, 255}, {87, 153, 153, 255}, {153, 153, 87, 255}, {204, 204, 204, 255},
+}
+
+// sixelDecoder paints sixel data into a growing image.
+type sixelDecoder struct {
+	img     *image.RGBA
+	palette [256]color.RGBA
+	color   int
+	x, y    int
+
+	// width and height are the extent painted so far, or set by the raster
+	// attributes.
+	width, height int
+}
+
+// decodeSixel decodes the body of a sixel DCS sequence, "P1;P2;P3q" and
+// the sixel data. Pixels no sixel sets are transparent if P2 is 1, and bg
+// otherwise.
+func decodeSixel(data []byte, bg color.Color) (image.Image, bool) {
+	params, body, ok := cutSixelParams(data)
+	if !ok {
+		return nil, false
+	}
+
+	d := &sixelDecoder{img: image.NewRGBA(image.Rect(0, 0, 0, 0))}
+	copy(d.palette[:], sixelPalette[:])
+
+	for i := 0; i < len(body); {
+		c := body[i]
+		i++
+		switch {
+		case c == '"':
+			var nums []int
+			nums, i = sixelNumbers(body, i)
+			if len(nums) >= 4 {
+				w, h := min(nums[2], maxSixelSize), min(nums[3], maxSixelSize)
+				d.grow(w, h)
+				d.width, d.height = max(d.width, w), max(d.height, h)
+			}
+		case c == '#':
+			var nums []int
+			nums, i = sixelNumbers(body, i)
+			if len(nums) == 0 {
+				continue
+			}
+			reg := nums[0] & 0xff
+			if len(nums) >= 5 {
+				d.palette[reg] = sixelColor(nums[1], nums[2], nums[3], nums[4])
+			}
+			d.color = reg
+		case c == '!':
+			var nums []int
+			nums, i = sixelNumbers(body, i)
+			if i < len(body) && len(nums) > 0 {
+				d.paint(body[i], nums[0])
+				i++
+			}
+		case c == '$':
+			d.x = 0
+		case c == '-':
+			d.x = 0
+			d.y += 6
+		case c >= '?' && c <= '~':
+			d.paint(c, 1)
+		}
+	}
+
+	img := d.img.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.RGBA)
+	if img.Bounds().Empty() {
+		return nil, false
+	}
+	if len(params) < 2 || params[1] != 1 {
+		out := image.NewRGBA(img.Bounds())
+		draw.Draw(out, out.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+		draw.Draw(out, out.Bounds(), img, image.Point{}, draw.Over)
+		return out, true
+	}
+	return img, true
+}
+
+// paint draws sixel character c n times at the current position.
+func (d *sixelDecoder) paint(c byte, n int) {
+	bits := c - '?'
+	n = min(n, maxSixelSize-d.x)
+	if n <= 0 || d.y+6 > maxSixelSize {
+		return
+	}
+	if bits != 0 {
+		d.grow(d.x+n, d.y+6)
+		col := d.palette[d.color]
+		for b := 0; b < 6; b++ {
+			if bits&(1<<b) == 0 {
+				continue
+			}
+			for x := d.x; x < d.x+n; x++ {
+				d.img.SetRGBA(x, d.y+b, col)
+			}
+			d.height = max(d.height, d.y+b+1)
+		}
+		d.width = max(d.width, d.x+n)
+	}
+	d.x += n
+}
+
+// grow makes the image at least w by h pixels, doubling to keep repeated
+// growth cheap.
+func (d *sixelDecoder) grow(w, h int) {
+	b := d.img.Bounds()
+	if w <= b.Dx() && h <= b.Dy() {
+		return
+	}
+	nw, nh := b.Dx(), b.Dy()
+	if w > nw {
+		nw = min(max(w, 2*nw), maxSixelSize)
+	}
+	if h > nh {
+		nh = min(max(h, 2*nh), maxSixelSize)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < b.Dy(); y++ {
+		copy(img.Pix[y*img.Stride:], d.img.Pix[y*d.img.Stride:y*d.img.Stride+b.Dx()*4])
+	}
+	d.img = img
+}
+
+// cutSixelParams splits "P1;P2;P3q..." into its parameters and the sixel
+// data after the q.
+func cutSixelParams(data []byte) (params []int, body []byte, ok bool) {
+	params, i := sixelNumbers(data, 0)
+	if i >= len(data) || data[i] != 'q' {
+		return nil, nil, false
+	}
+	return params, data[i+1:], true
+}
+
+// sixelNumbers parses semicolon-separated numbers starting at data[i],
+// returning them and the offset after them. Empty numbers are 0.
+func sixelNumbers(data []byte, i int) ([]int, int) {
+	var nums []int
+	n, digits := 0, false
+	for ; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c >= '0' && c <= '9':
+			if n < 1<<20 {
+				n = n*10 + int(c-'0')
+			}
+			digits = true
+		case c == ';':
+			nums = append(nums, n)
+			n, digits = 0, false
+		default:
+			if digits || len(nums) > 0 {
+				nums = append(nums, n)
+			}
+			return nums, i
+		}
+	}
+	if digits || len(nums) > 0 {
+		nums = append(nums, n)
+	}
+	return nums, i
+}
+
+// sixelColor converts a color definition: Pu 1 is HLS, with hue 0 blue as
+// on DEC terminals, and Pu 2 is RGB; both use percentages.
+func sixelColor(pu, a, b, c int) color.RGBA {
+	pct := func(v int) float64 { return float64(min(v, 100)) / 100 }
+	if pu == 1 {
+		r, g, bl := hlsToRGB(math.Mod(float64(a)+240, 360), pct(b), pct(c))
+		return color.RGBA{uint8(math.Round(r * 255)), uint8(math.Round(g * 255)), uint8(math.Round(bl * 255)), 255}
+	}
+	return color.RGBA{uint8(math.Round(pct(a) * 255)), uint8(math.Round(pct(b) * 255)), uint8(math.Round(pct(c) * 255)), 255}
+}
+
+// hlsToRGB converts hue in degrees, with red at 0, and lightness and
+// saturation in 0-1.
+func hlsToRGB(h, l, s float64) (r, g, b float64) {
+	if s == 0 {
+		return l, l, l
+	}
+	q := l + s - l*s
+	if l < 0.5 {
+		q = l * (1 + s)
+	}
+	p := 2*l - q
+	hue := func(t float64) float64 {
+		t = math.Mod(t+1, 1)
+		switch {
+		case t < 1.0/6:
+			return p + (q-p)*6*t
+		case t < 0.5:
+			return q
+		case t < 2.0/3:
+			return p + (q-p)*(2.0/3-t)*6
+		}
+		return p
+	}
+	h /= 360
+	return hue(h + 1.0/3), hue(h), hue(h - 1.0/3)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"regexp"
+	"specter/internal/protocol"
+	"time"
+)
+
+func (s *Server) handleStatus(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	rows, cols := sess.Emulator.Size()
+	result := protocol.StatusResult{
+		Command:  sess.Args,
+		Pid:      sess.Cmd.Process.Pid,
+		Exited:   sess.Exited,
+		ExitCode: sess.ExitCode,
+		Rows:     rows,
+		Cols:     cols,
+		Title:    sess.Term.title,
+		IconName: sess.Term.iconName,
+
+		Bells:         sess.Bells,
+		Notifications: sess.Notifications,
+	}
+	if err := sess.Output.fileErr; err != nil {
+		result.OutputLogError = err.Error()
+	}
+	return protocol.OK(result)
+}
+
+func (s *Server) handleTitle(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	sess.Mu.Lock()
+	defer sess.Mu.Unlock()
+
+	return protocol.OK(protocol.TitleResult{Title: sess.Term.title, IconName: sess.Term.iconName})
+}
+
+// handleWaitFor polls terminal state until every condition in the request
+// holds.
+func (s *Server) handleWaitFor(req protocol.Request) protocol.Response {
+	sess := s.session
+	if sess == nil {
+		return protocol.Errorf(protocol.ErrNoSession, "No session")
+	}
+
+	params := protocol.WaitForParams{Timeout: protocol.Duration(10 * time.Second)}
+	if err := req.DecodeParams(&params); err != nil {
+		return protocol.Errorf(protocol.ErrBadRequest, "Invalid wait-for params: %v", err)
+	}
+
+	var conds []func() bool
+	if params.Title != "" {
+		re, err := regexp.Compile(params.Title)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBadRequest, "Invalid pattern %q: %v", params.Title, err)
+		}
+		conds = append(conds, func() bool { return re.MatchString(sess.Term.title) })
+	}
+	if params.Bell {
+		conds = append(conds, sess.bellSinceInput)
+	}
+	for _, cond := range params.Modes {
+		name, value, err := parseModeCondition(cond)
+		if err != nil {
+			return protocol.Errorf(protocol.ErrBadRequest, "%v", err)
+		}
+		conds = append(conds, func() bool {
+			current, _ := modeValue(sess.Term.currentModes(), name)
+			return current == value
+		})
+	}
+	if len(conds) == 0 {
+		return protocol.Errorf(protocol.ErrBadRequest, "Nothing to wait for")
+	}
+
+	deadline := time.Now().Add(time.Duration(params.Timeout))
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		sess.Mu.Lock()
+		done := true
+		for _, cond := range conds {
+			done = done && cond()
+		}
+		result := protocol.WaitForResult{Title: sess.Term.title}
+		exited := sess.Exited
+		sess.Mu.Unlock()
+
+		if done {
+			return protocol.OK(result)
+		}
+		if exited {
+			return protocol.Errorf(protocol.ErrProcessExited, "Process exited before the condition held")
+		}
+		if time.Now().After(deadline) {
+			return protocol.Errorf(protocol.ErrTimeout, "Condition did not hold within %v", time.Duration(params.Timeout))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sess.ExitChan:
+		}
+	}
+}
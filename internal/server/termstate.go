@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"specter/internal/ansi"
+	"strconv"
+	"strings"
+)
+
+// DEC private modes tracked by termState.
+const (
+	modeAppCursor      = 1
+	modeAutowrap       = 7
+	modeCursorVisible  = 25
+	modeAltScreen      = 47
+	modeFocus          = 1004
+	modeAltScreen1047  = 1047
+	modeAltScreen1049  = 1049
+	modeBracketedPaste = 2004
+)
+
+// termState tracks terminal state that the Emulator interface does not
+// expose, by parsing the same output stream that is fed to the emulator.
+type termState struct {
+	parser ansi.Parser
+
+	// modes holds DEC private modes set with CSI ? Pm h and reset with
+	// CSI ? Pm l.
+	modes map[int]bool
+
+	// cursorShape is set with DECSCUSR (CSI Ps SP q).
+	cursorShape string
+
+	// appKeypad is set with DECKPAM (ESC =) and reset with DECKPNM (ESC >).
+	appKeypad bool
+
+	// title and iconName are set with OSC 0 (both), OSC 1 and OSC 2.
+	title, iconName string
+
+	// notify, if set, receives desktop notifications sent with OSC 9 and
+	// OSC 777.
+	notify func(title, body string)
+
+	// clipboard holds the virtual clipboard by OSC 52 selection name.
+	clipboard map[rune][]byte
+
+	// theme and identity decide the answers to color and terminal
+	// identification queries.
+	theme    *Theme
+	identity terminalIdentity
+
+	// queries collects the queries found by the current write.
+	queries []query
+
+	// graphics holds images shown with the kitty graphics protocol and
+	// sixel.
+	graphics graphics
+}
+
+func newTermState(theme *Theme, identity terminalIdentity) *termState {
+	t := &termState{
+		modes:       make(map[int]bool),
+		cursorShape: "block",
+		clipboard:   make(map[rune][]byte),
+		theme:       theme,
+		identity:    identity,
+	}
+	t.parser.CSI = t.handleCSI
+	t.parser.Escape = t.handleEscape
+	t.parser.String = t.handleString
+	return t
+}
+
+// write observes output from the PTY and returns the queries in it, in
+// order. Callers hold the session lock.
+func (t *termState) write(b []byte) []query {
+	t.queries = nil
+	t.parser.Feed(b)
+	return t.queries
+}
+
+func (t *termState) mode(n int) bool {
+	return t.modes[n]
+}
+
+// cursorVisible reports DECTCEM, which is on until an application hides
+// the cursor.
+func (t *termState) cursorVisible() bool {
+	visible, ok := t.modes[modeCursorVisible]
+	return !ok || visible
+}
+
+func (t *termState) handleCSI(seq ansi.CSI) {
+	switch {
+	case seq.Private == '>' && seq.Final == 'c' && seq.Param(0, 0) == 0:
+		// DA2
+		t.ask([]byte("\x1b[>" + t.identity.da2 + "c"))
+	case seq.Private == '>' && seq.Final == 'q' && seq.Param(0, 0) == 0:
+		// XTVERSION
+		t.ask([]byte("\x1bP>|" + t.identity.version + "\x1b\\"))
+	case seq.Private == 0 && seq.Final == 'c' && len(seq.Intermediates) == 0 && seq.Param(0, 0) == 0:
+		// DA1
+		t.ask([]byte("\x1b[?" + t.identity.da1 + "c"))
+	case (seq.Private == 0 || seq.Private == '?') && seq.Final == 'n',
+		seq.Final == 'p' && string(seq.Intermediates) == "$":
+		// DSR and DECRQM, which the emulator answers.
+		t.ask(nil)
+	case seq.Private == '?' && (seq.Final == 'h' || seq.Final == 'l'):
+		for _, m := range seq.Params {
+			t.modes[m] = seq.Final == 'h'
+			if m == modeAltScreen || m == modeAltScreen1047 || m == modeAltScreen1049 {
+				alt := seq.Final == 'h'
+				t.act(nil, func(Emulator) { t.graphics.setAlt(alt) })
+			}
+		}
+	case seq.Private == 0 && seq.Final == 'J' && len(seq.Intermediates) == 0 && seq.Param(0, 0) == 2:
+		// Clearing the screen removes its images.
+		t.act(nil, func(Emulator) { t.graphics.remove(func(placement) bool { return true }) })
+	case seq.Private == 0 && seq.Final == 'p' && string(seq.Intermediates) == "!":
+		// DECSTR soft reset.
+		t.reset(true)
+	case seq.Private == 0 && seq.Final == 'q' && string(seq.Intermediates) == " ":
+		switch seq.Param(0, 1) {
+		case 3, 4:
+			t.cursorShape = "underline"
+		case 5, 6:
+			t.cursorShape = "bar"
+		default:
+			t.cursorShape = "block"
+		}
+	}
+}
+
+func (t *termState) handleEscape(intermediates []byte, final byte) {
+	if len(intermediates) > 0 {
+		return
+	}
+	switch final {
+	case 'c':
+		// RIS full reset.
+		t.reset(false)
+		t.act(nil, func(Emulator) { t.graphics.reset() })
+	case '=':
+		t.appKeypad = true
+	case '>':
+		t.appKeypad = false
+	}
+}
+
+// reset returns modes to their defaults. A soft reset (DECSTR) does not
+// leave the alternate screen.
+func (t *termState) reset(soft bool) {
+	modes := make(map[int]bool)
+	if soft {
+		for _, m := range []int{modeAltScreen, modeAltScreen1047, modeAltScreen1049} {
+			if t.modes[m] {
+				modes[m] = true
+			}
+		}
+	}
+	t.modes = modes
+	t.cursorShape = "block"
+	t.appKeypad = false
+}
+
+func (t *termState) handleString(kind byte, data []byte) {
+	if kind == 'P' {
+		switch {
+		case bytes.HasPrefix(data, []byte("+q")):
+			t.queryCapabilities(string(data[2:]))
+		case bytes.HasPrefix(data, []byte("$q")):
+			// DECRQSS, which the emulator answers.
+			t.ask(nil)
+		default:
+			t.showSixel(data)
+		}
+		return
+	}
+	if kind == '_' && len(data) > 0 && data[0] == 'G' {
+		t.handleKitty(data[1:])
+		return
+	}
+	if kind != ']' {
+		return
+	}
+	cmd, arg, _ := bytes.Cut(data, []byte(";"))
+	text := strings.ToValidUTF8(string(arg), "\uFFFD")
+	switch string(cmd) {
+	case "0":
+		t.title, t.iconName = text, text
+	case "1":
+		t.iconName = text
+	case "2":
+		t.title = text
+	case "4":
+		t.queryPalette(text)
+	case "10", "11", "12":
+		code, _ := strconv.Atoi(string(cmd))
+		t.queryDynamicColors(code, text)
+	case "52":
+		t.setClipboard(text)
+	case "9":
+		// OSC 9;4 reports progress in ConEmu and Windows Terminal.
+		if t.notify != nil && !strings.HasPrefix(text, "4;") {
+			t.notify("", text)
+		}
+	case "777":
+		// rxvt-unicode: OSC 777;notify;title;body
+		kind, rest, _ := strings.Cut(text, ";")
+		title, body, _ := strings.Cut(rest, ";")
+		if t.notify != nil && kind == "notify" {
+			t.notify(title, body)
+		}
+	}
+}
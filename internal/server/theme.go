@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Theme sets the default colors, the 16 ANSI colors and the cursor color
+// used by the emulator and by rendered captures.
+type Theme struct {
+	Name       string
+	Foreground color.RGBA
+	Background color.RGBA
+	Cursor     color.RGBA
+	Palette    [16]color.RGBA
+}
+
+// themeFile is the JSON and TOML theme file format. Colors are "#rrggbb".
+type themeFile struct {
+	Name       string   `json:"name"`
+	Foreground string   `json:"foreground"`
+	Background string   `json:"background"`
+	Cursor     string   `json:"cursor"`
+	Palette    []string `json:"palette"`
+}
+
+// DefaultTheme is libvterm's own palette and default colors.
+const DefaultTheme = "libvterm"
+
+var themes = map[string]themeFile{
+	"libvterm": {
+		Foreground: "#f0f0f0",
+		Background: "#000000",
+		Cursor:     "#f0f0f0",
+		Palette: []string{
+			"#000000", "#e00000", "#00e000", "#e0e000", "#0000e0", "#e000e0", "#00e0e0", "#e0e0e0",
+			"#808080", "#ff4040", "#40ff40", "#ffff40", "#4040ff", "#ff40ff", "#40ffff", "#ffffff",
+		},
+	},
+	"xterm": {
+		Foreground: "#000000",
+		Background: "#ffffff",
+		Cursor:     "#000000",
+		Palette: []string{
+			"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+			"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+		},
+	},
+	"solarized-dark": {
+		Foreground: "#839496",
+		Background: "#002b36",
+		Cursor:     "#93a1a1",
+		Palette: []string{
+			"#073642", "#dc322f", "#859900", "#b58900", "#268bd2", "#d33682", "#2aa198", "#eee8d5",
+			"#002b36", "#cb4b16", "#586e75", "#657b83", "#839496", "#6c71c4", "#93a1a1", "#fdf6e3",
+		},
+	},
+	"solarized-light": {
+		Foreground: "#657b83",
+		Background: "#fdf6e3",
+		Cursor:     "#586e75",
+		Palette: []string{
+			"#073642", "#dc322f", "#859900", "#b58900", "#268bd2", "#d33682", "#2aa198", "#eee8d5",
+			"#002b36", "#cb4b16", "#586e75", "#657b83", "#839496", "#6c71c4", "#93a1a1", "#fdf6e3",
+		},
+	},
+	"dracula": {
+		Foreground: "#f8f8f2",
+		Background: "#282a36",
+		Cursor:     "#f8f8f2",
+		Palette: []string{
+			"#21222c", "#ff5555", "#50fa7b", "#f1fa8c", "#bd93f9", "#ff79c6", "#8be9fd", "#f8f8f2",
+			"#6272a4", "#ff6e6e", "#69ff94", "#ffffa5", "#d6acff", "#ff92df", "#a4ffff", "#ffffff",
+		},
+	},
+}
+
+// ThemeNames lists the built-in themes.
+func ThemeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadTheme returns the built-in theme called spec, or reads spec as a
+// JSON or TOML theme file. Colors a file leaves out come from the default
+// theme.
+func LoadTheme(spec string) (*Theme, error) {
+	if spec == "" {
+		spec = DefaultTheme
+	}
+	if f, ok := themes[spec]; ok {
+		f.Name = spec
+		return f.theme()
+	}
+
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("unknown theme %q (use %s, or a JSON or TOML file)", spec, strings.Join(ThemeNames(), ", "))
+	}
+
+	f := themes[DefaultTheme]
+	f.Name = spec
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = parseThemeTOML(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("theme %s: %v", spec, err)
+	}
+
+	t, err := f.theme()
+	if err != nil {
+		return nil, fmt.Errorf("theme %s: %v", spec, err)
+	}
+	return t, nil
+}
+
+func (f themeFile) theme() (*Theme, error) {
+	if len(f.Palette) != 16 {
+		return nil, fmt.Errorf("palette has %d colors, want 16", len(f.Palette))
+	}
+
+	t := &Theme{Name: f.Name}
+	var err error
+	if t.Foreground, err = parseColor(f.Foreground); err != nil {
+		return nil, err
+	}
+	if t.Background, err = parseColor(f.Background); err != nil {
+		return nil, err
+	}
+	if t.Cursor, err = parseColor(f.Cursor); err != nil {
+		return nil, err
+	}
+	for i, c := range f.Palette {
+		if t.Palette[i], err = parseColor(c); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseThemeTOML reads the flat subset of TOML theme files need: string
+// values and one array of strings, which may span lines.
+func parseThemeTOML(data []byte, f *themeFile) error {
+	var pending strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 && !strings.Contains(line[:i], `"`) {
+			line = line[:i]
+		}
+		pending.WriteString(line)
+
+		stmt := strings.TrimSpace(pending.String())
+		if stmt == "" {
+			pending.Reset()
+			continue
+		}
+		if strings.Count(stmt, "[") > strings.Count(stmt, "]") {
+			continue
+		}
+		pending.Reset()
+
+		key, value, ok := strings.Cut(stmt, "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected key = value", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "palette" {
+			if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+				return fmt.Errorf("line %d: palette must be an array", n)
+			}
+			f.Palette = nil
+			for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				s, err := strconv.Unquote(item)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid string %s", n, item)
+				}
+				f.Palette = append(f.Palette, s)
+			}
+			continue
+		}
+
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid string %s", n, value)
+		}
+		switch key {
+		case "name":
+			f.Name = s
+		case "foreground":
+			f.Foreground = s
+		case "background":
+			f.Background = s
+		case "cursor":
+			f.Cursor = s
+		default:
+			return fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	if pending.Len() > 0 {
+		return fmt.Errorf("unterminated array")
+	}
+	return scanner.Err()
+}
+
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q (use #rrggbb)", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q (use #rrggbb)", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// vtermPalette is libvterm's built-in ANSI palette, which the go emulator
+// reports as well.
+var vtermPalette = [16]color.RGBA{
+	{0, 0, 0, 255}, {224, 0, 0, 255}, {0, 224, 0, 255}, {224, 224, 0, 255},
+	{0, 0, 224, 255}, {224, 0, 224, 255}, {0, 224, 224, 255}, {224, 224, 224, 255},
+	{128, 128, 128, 255}, {255, 64, 64, 255}, {64, 255, 64, 255}, {255, 255, 64, 255},
+	{64, 64, 255, 255}, {255, 64, 255, 255}, {64, 255, 255, 255}, {255, 255, 255, 255},
+}
+
+// color maps a cell color through the theme. The emulators cannot be given
+// the theme palette, so the 16 ANSI colors are replaced here by index;
+// colors set as RGB or from the 256-color cube are kept even where they
+// match a palette entry.
+func (t *Theme) color(c color.Color) color.Color {
+	if p, ok := c.(paletteColor); ok {
+		return t.Palette[p.index]
+	}
+	return c
+}
@@ -1,10 +1,22 @@
 package tests
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"specter/internal/ansi"
+	"specter/internal/client"
 	"specter/internal/protocol"
 	"specter/internal/server"
 	"strings"
@@ -16,7 +28,7 @@ func TestIntegration(t *testing.T) {
 	os.Remove(server.SocketName)
 
 	go func() {
-		if err := server.Start([]string{"/bin/sh", "-c", "echo hello world; sleep 2"}); err != nil {
+		if err := server.Start([]string{"/bin/sh", "-c", "echo hello world; sleep 2"}, server.Options{}); err != nil {
 			t.Logf("Server stopped: %v", err)
 		}
 	}()
@@ -39,41 +51,31 @@ func TestIntegration(t *testing.T) {
 		}
 	}
 
-	send := func(req protocol.Request) protocol.Response {
-		conn, err := net.Dial("unix", server.SocketName)
+	call := func(op protocol.Op, params, result interface{}) error {
+		c, err := client.Dial()
 		if err != nil {
 			t.Fatalf("Failed to connect: %v", err)
 		}
-		defer conn.Close()
+		defer c.Close()
 
-		json.NewEncoder(conn).Encode(req)
-		var resp protocol.Response
-		json.NewDecoder(conn).Decode(&resp)
-		return resp
+		return c.Call(op, params, result)
 	}
 
 	time.Sleep(500 * time.Millisecond)
 
-	capResp := send(protocol.Request{
-		Op: protocol.OpCapture,
-	})
-
-	if capResp.Status != "ok" {
-		t.Fatalf("Capture failed: %s", capResp.Message)
+	var capture protocol.CaptureResult
+	if err := call(protocol.OpCapture, nil, &capture); err != nil {
+		t.Fatalf("Capture failed: %v", err)
 	}
 
-	t.Logf("Capture output:\n%s", capResp.Data)
+	t.Logf("Capture output:\n%s", capture.Text)
 
-	if !strings.Contains(capResp.Data, "hello world") {
+	if !strings.Contains(capture.Text, "hello world") {
 		t.Error("Did not find 'hello world' in capture output")
 	}
 
-	killResp := send(protocol.Request{
-		Op: protocol.OpKill,
-	})
-
-	if killResp.Status != "ok" {
-		t.Fatalf("Kill failed: %s", killResp.Message)
+	if err := call(protocol.OpKill, nil, nil); err != nil {
+		t.Fatalf("Kill failed: %v", err)
 	}
 
 	time.Sleep(100 * time.Millisecond)
@@ -83,7 +85,7 @@ func TestInteractive(t *testing.T) {
 	os.Remove(server.SocketName)
 
 	go func() {
-		if err := server.Start([]string{"/bin/cat"}); err != nil {
+		if err := server.Start([]string{"/bin/cat"}, server.Options{}); err != nil {
 			t.Logf("Server stopped: %v", err)
 		}
 	}()
@@ -106,58 +108,50 @@ func TestInteractive(t *testing.T) {
 		}
 	}
 
-	send := func(req protocol.Request) protocol.Response {
-		conn, err := net.Dial("unix", server.SocketName)
+	call := func(op protocol.Op, params, result interface{}) error {
+		c, err := client.Dial()
 		if err != nil {
 			t.Fatalf("Failed to connect: %v", err)
 		}
-		defer conn.Close()
+		defer c.Close()
 
-		json.NewEncoder(conn).Encode(req)
-		var resp protocol.Response
-		json.NewDecoder(conn).Decode(&resp)
-		return resp
+		return c.Call(op, params, result)
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
-	typeResp := send(protocol.Request{
-		Op:      protocol.OpType,
-		Payload: []string{"foo bar\n"},
-	})
+	fetch := func(op protocol.Op, params interface{}) ([]byte, error) {
+		c, err := client.Dial()
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer c.Close()
 
-	if typeResp.Status != "ok" {
-		t.Fatalf("Type failed: %s", typeResp.Message)
+		var body bytes.Buffer
+		err = c.Fetch(op, params, nil, &body)
+		return body.Bytes(), err
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
-	capResp := send(protocol.Request{
-		Op: protocol.OpCapture,
-	})
-
-	if capResp.Status != "ok" {
-		t.Fatalf("Capture failed: %s", capResp.Message)
+	if err := call(protocol.OpType, protocol.TypeParams{Text: "foo bar\n"}, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
 	}
 
-	t.Logf("Capture output:\n%s", capResp.Data)
+	time.Sleep(100 * time.Millisecond)
 
-	if !strings.Contains(capResp.Data, "foo bar") {
-		t.Error("Did not find 'foo bar' in capture output for cat session")
+	var capture protocol.CaptureResult
+	if err := call(protocol.OpCapture, nil, &capture); err != nil {
+		t.Fatalf("Capture failed: %v", err)
 	}
 
-	pngResp := send(protocol.Request{
-		Op:      protocol.OpCapture,
-		Options: map[string]string{"format": "png"},
-	})
+	t.Logf("Capture output:\n%s", capture.Text)
 
-	if pngResp.Status != "ok" {
-		t.Fatalf("Capture PNG failed: %s", pngResp.Message)
+	if !strings.Contains(capture.Text, "foo bar") {
+		t.Error("Did not find 'foo bar' in capture output for cat session")
 	}
 
-	pngData, err := base64.StdEncoding.DecodeString(pngResp.Data)
+	pngData, err := fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png"})
 	if err != nil {
-		t.Fatalf("Failed to decode PNG data: %v", err)
+		t.Fatalf("Capture PNG failed: %v", err)
 	}
 
 	expectedMagic := []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
@@ -171,8 +165,1826 @@ func TestInteractive(t *testing.T) {
 		}
 	}
 
-	os.WriteFile("test_output.png", pngData, 0644)
+	os.WriteFile(filepath.Join(t.TempDir(), "test_output.png"), pngData, 0644)
+
+	call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandshake(t *testing.T) {
+	os.Remove(server.SocketName)
+
+	go func() {
+		if err := server.Start([]string{"/bin/cat"}, server.Options{}); err != nil {
+			t.Logf("Server stopped: %v", err)
+		}
+	}()
+
+	timeout := time.After(2 * time.Second)
+	ticker := time.NewTicker(100 * time.Millisecond)
+
+	connected := false
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("Timeout waiting for server socket")
+		case <-ticker.C:
+			if _, err := os.Stat(server.SocketName); err == nil {
+				connected = true
+			}
+		}
+		if connected {
+			break
+		}
+	}
+
+	raw := func(reqs ...protocol.Request) []protocol.Response {
+		conn, err := net.Dial("unix", server.SocketName)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+
+		encoder := json.NewEncoder(conn)
+		decoder := json.NewDecoder(conn)
+		var resps []protocol.Response
+		for _, req := range reqs {
+			encoder.Encode(req)
+			var resp protocol.Response
+			if err := decoder.Decode(&resp); err != nil {
+				break
+			}
+			resps = append(resps, resp)
+		}
+		return resps
+	}
+
+	// A client that skips the hello is refused.
+	resps := raw(protocol.Request{Op: protocol.OpHistory})
+	if len(resps) != 1 || resps[0].Code != protocol.ErrIncompatible {
+		t.Fatalf("Expected incompatible_version without hello, got %+v", resps)
+	}
+
+	// A client that only speaks a future version is refused.
+	future, _ := protocol.NewRequest(protocol.OpHello, protocol.Hello{Version: protocol.Version + 1, MinVersion: protocol.Version + 1})
+	resps = raw(future)
+	if len(resps) != 1 || resps[0].Code != protocol.ErrIncompatible {
+		t.Fatalf("Expected incompatible_version for future client, got %+v", resps)
+	}
+
+	// Clients that do not ask for framing get bodies base64-encoded in JSON.
+	hello, _ := protocol.NewRequest(protocol.OpHello, protocol.Hello{Version: protocol.Version, MinVersion: protocol.MinVersion})
+	capture, _ := protocol.NewRequest(protocol.OpCapture, protocol.CaptureParams{Format: "png"})
+	resps = raw(hello, capture)
+	if len(resps) != 2 || resps[1].Status != protocol.StatusOK || !bytes.HasPrefix(resps[1].Body, []byte("\x89PNG")) {
+		t.Fatalf("Expected PNG body over JSON, got %d responses", len(resps))
+	}
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if !c.Has(protocol.FeatureFramed) {
+		t.Errorf("Server did not advertise %s", protocol.FeatureFramed)
+	}
+	if c.Server.Version != protocol.Version {
+		t.Errorf("Negotiated v%d, want v%d", c.Server.Version, protocol.Version)
+	}
+
+	err = c.Call("bogus", nil, nil)
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.ErrUnknownOp {
+		t.Errorf("Expected unknown_op, got %v", err)
+	}
+
+	err = c.Call(protocol.OpWait, protocol.WaitParams{Timeout: protocol.Duration(50 * time.Millisecond)}, nil)
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.ErrTimeout {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	body := strings.Repeat("x", 100000)
+	if err := protocol.WriteFrame(&buf, protocol.Response{ID: "1"}, protocol.Bytes([]byte(body))); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+
+	var resp protocol.Response
+	r, size, err := protocol.ReadFrame(&buf, &resp)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	if resp.ID != "1" || size != int64(len(body)) || string(got) != body {
+		t.Errorf("Read frame %q with a %d byte body, want %d bytes", resp.ID, len(got), len(body))
+	}
+
+	// A payload that writes less than it announced leaves the stream
+	// unusable, so it is reported.
+	if err := protocol.WriteFrame(io.Discard, protocol.Response{}, shortPayload{}); err == nil {
+		t.Error("Expected an error for a short payload")
+	}
+
+	resp = protocol.Response{Payload: protocol.Bytes([]byte("abc"))}
+	if err := resp.Inline(); err != nil || string(resp.Body) != "abc" || resp.Payload != nil {
+		t.Errorf("Inline left body %q, payload %v, err %v", resp.Body, resp.Payload, err)
+	}
+}
+
+type shortPayload struct{}
+
+func (shortPayload) Size() int64 { return 10 }
+
+func (shortPayload) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("abc"))
+	return int64(n), err
+}
+
+func TestKillUnversioned(t *testing.T) {
+	// A server from before the hello exchange: one request per connection,
+	// and anything but its own ops is an unknown operation.
+	os.Remove(server.SocketName)
+	ln, err := net.Listen("unix", server.SocketName)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	defer os.Remove(server.SocketName)
+
+	killed := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req struct {
+				Op string `json:"op"`
+			}
+			json.NewDecoder(conn).Decode(&req)
+			if req.Op == "kill" {
+				conn.Write([]byte(`{"status":"ok"}` + "\n"))
+				killed <- true
+			} else {
+				conn.Write([]byte(`{"status":"error","message":"Unknown operation"}` + "\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	if _, err := client.Dial(); err == nil || !strings.Contains(err.Error(), "unversioned") {
+		t.Errorf("Expected Dial to report an unversioned server, got %v", err)
+	}
+
+	client.Kill()
+	select {
+	case <-killed:
+	case <-time.After(time.Second):
+		t.Error("Kill did not send the legacy kill request")
+	}
+}
+
+// startServer runs a specter server for cmd and returns once its socket
+// is accepting connections.
+func startServer(t *testing.T, opts server.Options, cmd ...string) {
+	t.Helper()
+	os.Remove(server.SocketName)
+
+	go func() {
+		if err := server.Start(cmd, opts); err != nil {
+			t.Logf("Server stopped: %v", err)
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(server.SocketName); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for server socket")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/cat")
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	step := func(id string, op protocol.Op, params interface{}) protocol.Request {
+		req, err := protocol.NewRequest(op, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ID = id
+		return req
+	}
+
+	var result protocol.BatchResult
+	err = c.Call(protocol.OpBatch, protocol.BatchParams{Steps: []protocol.Request{
+		step("a", protocol.OpType, protocol.TypeParams{Text: "batched\n"}),
+		step("b", protocol.OpWaitStable, protocol.WaitStableParams{Quiet: protocol.Duration(100 * time.Millisecond)}),
+		step("c", protocol.OpCapture, nil),
+		step("d", "bogus", nil),
+		step("e", protocol.OpHistory, nil),
+	}}, &result)
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	if len(result.Steps) != 4 {
+		t.Fatalf("Expected 4 executed steps (stopping at the failure), got %d", len(result.Steps))
+	}
+	for i, id := range []string{"a", "b", "c", "d"} {
+		if result.Steps[i].ID != id {
+			t.Errorf("Step %d has id %q, want %q", i, result.Steps[i].ID, id)
+		}
+	}
+
+	var capture protocol.CaptureResult
+	result.Steps[2].DecodeResult(&capture)
+	if !strings.Contains(capture.Text, "batched") {
+		t.Errorf("Capture step did not see typed text:\n%s", capture.Text)
+	}
+	if result.Steps[3].Code != protocol.ErrUnknownOp {
+		t.Errorf("Expected unknown_op for bogus step, got %+v", result.Steps[3])
+	}
+
+	// A wait with no timeout would hold off every other client for as long
+	// as cat runs, so the batch is refused before any step runs.
+	err = c.Call(protocol.OpBatch, protocol.BatchParams{Steps: []protocol.Request{
+		step("a", protocol.OpType, protocol.TypeParams{Text: "unbounded\n"}),
+		step("b", protocol.OpWait, nil),
+	}}, nil)
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.ErrBadRequest {
+		t.Errorf("Expected bad_request for an unbounded wait, got %v", err)
+	}
+	err = c.Call(protocol.OpBatch, protocol.BatchParams{Steps: []protocol.Request{
+		step("a", protocol.OpWait, protocol.WaitParams{Timeout: protocol.Duration(50 * time.Millisecond)}),
+	}}, &result)
+	if err != nil || len(result.Steps) != 1 || result.Steps[0].Code != protocol.ErrTimeout {
+		t.Errorf("Expected a bounded wait step to time out, got %+v, %v", result.Steps, err)
+	}
+	var hist protocol.HistoryResult
+	c.Call(protocol.OpHistory, nil, &hist)
+	for _, ev := range hist.Events {
+		if strings.Contains(string(ev.Data), "unbounded") {
+			t.Error("Refused batch typed its first step")
+		}
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHistory(t *testing.T) {
+	// Replay runs in a child process, since the client exits on errors.
+	if file := os.Getenv("SPECTER_REPLAY"); file != "" {
+		client.Replay([]string{file})
+		return
+	}
+
+	startServer(t, server.Options{}, "/bin/cat")
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "hello\n"}, nil)
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\x1b[A"}, nil)
+	if err := c.Call(protocol.OpResize, protocol.ResizeParams{Rows: 20, Cols: 60}, nil); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	if err := c.Call(protocol.OpSignal, protocol.SignalParams{Signal: "nope"}, nil); err == nil {
+		t.Error("Expected unknown signal to fail")
+	}
+
+	var hist protocol.HistoryResult
+	if err := c.Call(protocol.OpHistory, nil, &hist); err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+
+	if len(hist.Command) != 1 || hist.Command[0] != "/bin/cat" {
+		t.Errorf("Unexpected command %v", hist.Command)
+	}
+
+	want := []protocol.InputKind{protocol.InputText, protocol.InputKey, protocol.InputResize}
+	if len(hist.Events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), hist.Events)
+	}
+	for i, kind := range want {
+		ev := hist.Events[i]
+		if ev.Kind != kind {
+			t.Errorf("Event %d has kind %s, want %s", i, ev.Kind, kind)
+		}
+		if !strings.HasPrefix(ev.Client, "specter/") || ev.Time.IsZero() {
+			t.Errorf("Event %d missing client or time: %+v", i, ev)
+		}
+	}
+	if string(hist.Events[0].Data) != "hello\n" || hist.Events[2].Rows != 20 || hist.Events[2].Cols != 60 {
+		t.Errorf("Unexpected event payloads: %+v", hist.Events)
+	}
+
+	// Replay needs a fresh session and leaves the running one alone.
+	file := filepath.Join(t.TempDir(), "history.json")
+	data, _ := json.Marshal(hist)
+	os.WriteFile(file, data, 0o644)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHistory$")
+	cmd.Env = append(os.Environ(), "SPECTER_REPLAY="+file)
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "already running") {
+		t.Errorf("Expected replay to refuse a running session, got %v: %s", err, out)
+	}
+	var after protocol.HistoryResult
+	c.Call(protocol.OpHistory, nil, &after)
+	if len(after.Events) != len(hist.Events) {
+		t.Errorf("Replay sent events to the running session: %+v", after.Events)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestReplay(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not on PATH")
+	}
+
+	// Replay spawns its session by running its own executable, so it needs
+	// the real binary, run in a directory of its own.
+	bin := filepath.Join(t.TempDir(), "specter")
+	if out, err := exec.Command("go", "build", "-o", bin, "specter/cmd/specter").CombinedOutput(); err != nil {
+		t.Fatalf("Build failed: %v\n%s", err, out)
+	}
+	dir := t.TempDir()
+	specter := func(args ...string) []byte {
+		cmd := exec.Command(bin, args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("specter %s failed: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	// The program keeps printing for a while, and input sent before it
+	// settles would reach it before it was recorded to.
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	recorded := protocol.HistoryResult{
+		Command: []string{"/bin/sh", "-c", `for i in 1 2 3 4 5 6; do printf .; sleep 0.1; done; echo ready; read a; echo "got $a"; read b; echo "then $b"; sleep 10`},
+		Events: []protocol.InputEvent{
+			{Time: at, Kind: protocol.InputText, Data: []byte("hello\n")},
+			{Time: at.Add(100 * time.Millisecond), Kind: protocol.InputResize, Rows: 20, Cols: 60},
+			{Time: at.Add(1100 * time.Millisecond), Kind: protocol.InputText, Data: []byte("world\n")},
+		},
+	}
+	file := filepath.Join(dir, "history.json")
+	data, _ := json.Marshal(recorded)
+	os.WriteFile(file, data, 0o644)
+
+	// The spawned server inherits replay's output, so it goes to a file
+	// rather than a pipe that would stay open until the server exits.
+	logFile, err := os.Create(filepath.Join(t.TempDir(), "replay.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	replay := exec.Command(bin, "replay", file, "--speed", "4x")
+	replay.Dir = dir
+	replay.Stdout, replay.Stderr = logFile, logFile
+	start := time.Now()
+	if err := replay.Run(); err != nil {
+		out, _ := os.ReadFile(logFile.Name())
+		t.Fatalf("Replay failed: %v\n%s", err, out)
+	}
+	defer specter("kill")
+
+	var status protocol.StatusResult
+	json.Unmarshal(specter("status", "--json"), &status)
+	if !reflect.DeepEqual(status.Command, recorded.Command) {
+		t.Errorf("Replay spawned %v, want %v", status.Command, recorded.Command)
+	}
+	if status.Rows != 20 || status.Cols != 60 {
+		t.Errorf("Replayed size is %dx%d, want 20x60", status.Rows, status.Cols)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if screen := string(specter("capture")); !strings.Contains(screen, "got hello") || !strings.Contains(screen, "then world") {
+		t.Errorf("Unexpected screen after replay:\n%s", screen)
+	}
+
+	var hist protocol.HistoryResult
+	json.Unmarshal(specter("history", "--json"), &hist)
+	if len(hist.Events) != len(recorded.Events) {
+		t.Fatalf("Expected %d replayed events, got %+v", len(recorded.Events), hist.Events)
+	}
+	for i, ev := range hist.Events {
+		want := recorded.Events[i]
+		if ev.Kind != want.Kind || string(ev.Data) != string(want.Data) || ev.Rows != want.Rows || ev.Cols != want.Cols {
+			t.Errorf("Event %d is %+v, want %+v", i, ev, want)
+		}
+	}
+	if d := hist.Events[0].Time.Sub(start); d < 500*time.Millisecond {
+		t.Errorf("First event sent %v after replay started, before the output settled", d)
+	}
+	// The recorded one second gap, at 4x.
+	if d := hist.Events[2].Time.Sub(hist.Events[1].Time); d < 150*time.Millisecond || d > 700*time.Millisecond {
+		t.Errorf("Replayed gap is %v, want about 250ms", d)
+	}
+}
+
+func TestOutputLog(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "out.log")
+	startServer(t, server.Options{OutputLog: logPath}, "/bin/sh", "-c", `printf '\033[31mred\033[0m\n'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.OutputResult
+	var body bytes.Buffer
+	if err := c.Fetch(protocol.OpOutput, nil, &result, &body); err != nil {
+		t.Fatalf("Output failed: %v", err)
+	}
+	if err := result.SetData(body.Bytes()); err != nil {
+		t.Fatalf("Output chunks do not match the body: %v", err)
+	}
+
+	var all []byte
+	for i, chunk := range result.Chunks {
+		if i > 0 && chunk.Offset < result.Chunks[i-1].Offset {
+			t.Errorf("Chunk %d offset went backwards", i)
+		}
+		all = append(all, chunk.Data...)
+	}
+	if !bytes.Contains(all, []byte("\x1b[31mred\x1b[0m")) {
+		t.Errorf("Raw output missing escape sequences: %q", all)
+	}
+	if got := string(ansi.Strip(all)); got != "red\n" {
+		t.Errorf("Strip gave %q, want %q", got, "red\n")
+	}
+
+	logData, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read output log: %v", err)
+	}
+	if !strings.Contains(string(logData), `\x1b[31mred`) {
+		t.Errorf("Output log missing quoted chunk:\n%s", logData)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestOutputLogWriteError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full is not available")
+	}
+	startServer(t, server.Options{OutputLog: "/dev/full"}, "/bin/sh", "-c", `echo one; sleep 0.1; echo two; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(400 * time.Millisecond)
+
+	// The session carries on without the file and keeps the log in memory.
+	var status protocol.StatusResult
+	if err := c.Call(protocol.OpStatus, nil, &status); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(status.OutputLogError, "no space left") {
+		t.Errorf("Expected the write error in status, got %q", status.OutputLogError)
+	}
+	var screen protocol.CaptureResult
+	c.Call(protocol.OpCapture, nil, &screen)
+	if !strings.Contains(screen.Text, "two") {
+		t.Errorf("Session stopped after the write error:\n%s", screen.Text)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestOutputLogLarge(t *testing.T) {
+	// Output that would not fit in a response header once base64-encoded.
+	const size = 13 << 20
+	startServer(t, server.Options{}, "/bin/sh", "-c", fmt.Sprintf(`head -c %d /dev/zero | tr '\0' x; sleep 30`, size))
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	var total int
+	for deadline := time.Now().Add(30 * time.Second); total < size && time.Now().Before(deadline); {
+		time.Sleep(200 * time.Millisecond)
+		var result protocol.OutputResult
+		var body bytes.Buffer
+		if err := c.Fetch(protocol.OpOutput, nil, &result, &body); err != nil {
+			t.Fatalf("Output failed: %v", err)
+		}
+		if err := result.SetData(body.Bytes()); err != nil {
+			t.Fatalf("Output chunks do not match the body: %v", err)
+		}
+		total = body.Len()
+	}
+	if total < size {
+		t.Errorf("Output log holds %d bytes, want %d", total, size)
+	}
 
-	send(protocol.Request{Op: protocol.OpKill})
+	c.Call(protocol.OpKill, nil, nil)
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestStripANSI(t *testing.T) {
+	cases := map[string]string{
+		"plain":                 "plain",
+		"\x1b[1;32mok\x1b[m":    "ok",
+		"\x1b]0;title\x07after": "after",
+		"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\": "link",
+		"\x1b(Bx\x1b=y":  "xy",
+		"a\rb\x07c\td\n": "abc\td\n",
+	}
+	for in, want := range cases {
+		if got := string(ansi.Strip([]byte(in))); got != want {
+			t.Errorf("Strip(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf 'ready\n'; read line; printf '\033[?2004h'; exec cat`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	var result protocol.PasteResult
+	if err := c.Call(protocol.OpPaste, protocol.PasteParams{Text: "first\n"}, &result); err != nil {
+		t.Fatalf("Paste failed: %v", err)
+	}
+	if result.Bracketed {
+		t.Error("Paste was bracketed before the app enabled mode 2004")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if err := c.Call(protocol.OpPaste, protocol.PasteParams{Text: "a\nb\x1b[201~c"}, &result); err != nil {
+		t.Fatalf("Paste failed: %v", err)
+	}
+	if !result.Bracketed {
+		t.Error("Paste was not bracketed after the app enabled mode 2004")
+	}
+
+	var hist protocol.HistoryResult
+	c.Call(protocol.OpHistory, nil, &hist)
+	if len(hist.Events) != 2 || hist.Events[1].Kind != protocol.InputPaste {
+		t.Fatalf("Expected two paste events, got %+v", hist.Events)
+	}
+	if got := string(hist.Events[1].Data); got != "\x1b[200~a\nbc\x1b[201~" {
+		t.Errorf("Unexpected bracketed paste bytes %q", got)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestParserSplitSequences(t *testing.T) {
+	var csis []ansi.CSI
+	var strs []string
+	p := ansi.Parser{
+		CSI:    func(seq ansi.CSI) { csis = append(csis, seq) },
+		String: func(kind byte, data []byte) { strs = append(strs, string(kind)+string(data)) },
+	}
+
+	input := "x\x1b[?1000;1006hy\x1b]2;my title\x07\x1b[5;10Hz\x1b]52;c;aGk=\x1b\\"
+	for i := 0; i < len(input); i++ {
+		p.Feed([]byte{input[i]})
+	}
+
+	if len(csis) != 2 {
+		t.Fatalf("Expected 2 CSI sequences, got %+v", csis)
+	}
+	if csis[0].Private != '?' || csis[0].Final != 'h' || len(csis[0].Params) != 2 || csis[0].Params[1] != 1006 {
+		t.Errorf("Unexpected mode sequence %+v", csis[0])
+	}
+	if csis[1].Final != 'H' || csis[1].Param(0, 1) != 5 || csis[1].Param(1, 1) != 10 {
+		t.Errorf("Unexpected cursor sequence %+v", csis[1])
+	}
+	if len(strs) != 2 || strs[0] != "]2;my title" || strs[1] != "]52;c;aGk=" {
+		t.Errorf("Unexpected strings %q", strs)
+	}
+}
+
+func TestParserSubparams(t *testing.T) {
+	var seq ansi.CSI
+	p := ansi.Parser{CSI: func(s ansi.CSI) { seq = s }}
+
+	// Colon-separated values stay with the parameter they follow.
+	p.Feed([]byte("\x1b[1;38:2::255:0:0;4:3;7m"))
+	if want := []int{1, 38, 4, 7}; !reflect.DeepEqual(seq.Params, want) {
+		t.Errorf("Params are %v, want %v", seq.Params, want)
+	}
+	if want := [][]int{nil, {2, 0, 255, 0, 0}, {3}}; !reflect.DeepEqual(seq.Subparams, want) {
+		t.Errorf("Subparams are %v, want %v", seq.Subparams, want)
+	}
+	if seq.Sub(3) != nil {
+		t.Errorf("Parameter without subparameters has %v", seq.Sub(3))
+	}
+}
+
+func TestMouse(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `read line; printf '\033[?1000h'; read line; printf '\033[?1006h'; read line; printf '\033[?1006l\033[?1005h'; exec cat`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	click := protocol.MouseParams{Action: "click", Row: 2, Col: 4}
+	if err := c.Call(protocol.OpMouse, click, nil); err == nil {
+		t.Fatal("Expected an error while mouse reporting is off")
+	}
+
+	lastInput := func() string {
+		var hist protocol.HistoryResult
+		c.Call(protocol.OpHistory, nil, &hist)
+		return string(hist.Events[len(hist.Events)-1].Data)
+	}
+
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil)
+	time.Sleep(200 * time.Millisecond)
+
+	var result protocol.MouseResult
+	if err := c.Call(protocol.OpMouse, click, &result); err != nil {
+		t.Fatalf("Click failed: %v", err)
+	}
+	if result.Tracking != "normal" || result.Encoding != "x10" {
+		t.Errorf("Unexpected mode %+v", result)
+	}
+	if got := lastInput(); got != "\x1b[M\x20\x25\x23\x1b[M\x23\x25\x23" {
+		t.Errorf("Unexpected X10 click %q", got)
+	}
+
+	drag := protocol.MouseParams{Action: "drag", Row: 0, Col: 0, ToRow: 0, ToCol: 2}
+	if err := c.Call(protocol.OpMouse, drag, nil); err == nil {
+		t.Error("Expected drag to fail in normal tracking mode")
+	}
+
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil)
+	time.Sleep(200 * time.Millisecond)
+
+	rightCtrl := protocol.MouseParams{Action: "click", Row: 2, Col: 4, Button: "right", Mods: []string{"C"}}
+	if err := c.Call(protocol.OpMouse, rightCtrl, &result); err != nil {
+		t.Fatalf("Click failed: %v", err)
+	}
+	if got := lastInput(); got != "\x1b[<18;5;3M\x1b[<18;5;3m" {
+		t.Errorf("Unexpected SGR click %q", got)
+	}
+
+	if err := c.Call(protocol.OpMouse, protocol.MouseParams{Action: "scroll", Row: 0, Col: 0, Button: "down"}, nil); err != nil {
+		t.Fatalf("Scroll failed: %v", err)
+	}
+	if got := lastInput(); got != "\x1b[<65;1;1M" {
+		t.Errorf("Unexpected SGR scroll %q", got)
+	}
+
+	c.Call(protocol.OpResize, protocol.ResizeParams{Rows: 24, Cols: 200}, nil)
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil)
+	time.Sleep(200 * time.Millisecond)
+
+	wide := protocol.MouseParams{Action: "scroll", Row: 1, Col: 150, Button: "right", Mods: []string{"S", "M", "C"}}
+	if err := c.Call(protocol.OpMouse, wide, &result); err != nil {
+		t.Fatalf("Scroll failed: %v", err)
+	}
+	if result.Encoding != "utf8" {
+		t.Errorf("Unexpected encoding %q", result.Encoding)
+	}
+	if got, want := lastInput(), "\x1b[M"+string(rune(32+95))+string(rune(32+151))+string(rune(32+2)); got != want {
+		t.Errorf("Unexpected UTF-8 scroll %q, want %q", got, want)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestFind(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf '[ OK ]  [ Cancel ]\nnothing\n  cancel here\n'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.FindResult
+	if err := c.Call(protocol.OpFind, protocol.FindParams{Pattern: "Cancel"}, &result); err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if len(result.Matches) != 1 {
+		t.Fatalf("Expected 1 match, got %+v", result.Matches)
+	}
+	if m := result.Matches[0]; m.Row != 0 || m.Col != 10 || m.EndCol != 16 {
+		t.Errorf("Unexpected span %+v", m)
+	}
+
+	if err := c.Call(protocol.OpFind, protocol.FindParams{Pattern: "cancel", IgnoreCase: true}, &result); err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if len(result.Matches) != 2 || result.Matches[1].Row != 2 || result.Matches[1].Col != 2 {
+		t.Errorf("Unexpected case-insensitive matches %+v", result.Matches)
+	}
+
+	if err := c.Call(protocol.OpFind, protocol.FindParams{Pattern: `\[ \w+ \]`, Regex: true}, &result); err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if len(result.Matches) != 2 || result.Matches[0].Text != "[ OK ]" {
+		t.Errorf("Unexpected regex matches %+v", result.Matches)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTypeDelay(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/cat")
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	params := protocol.TypeParams{
+		Text:   "ab\x1b[Aé\n",
+		Delay:  protocol.Duration(40 * time.Millisecond),
+		Jitter: protocol.Duration(10 * time.Millisecond),
+	}
+	if err := c.Call(protocol.OpType, params, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 4*30*time.Millisecond {
+		t.Errorf("Type returned after %v, before all delayed keystrokes", elapsed)
+	}
+
+	var hist protocol.HistoryResult
+	c.Call(protocol.OpHistory, nil, &hist)
+
+	want := []string{"a", "b", "\x1b[A", "é", "\n"}
+	if len(hist.Events) != len(want) {
+		t.Fatalf("Expected %d keystrokes, got %+v", len(want), hist.Events)
+	}
+	for i, key := range want {
+		if string(hist.Events[i].Data) != key {
+			t.Errorf("Keystroke %d is %q, want %q", i, hist.Events[i].Data, key)
+		}
+		if i > 0 && hist.Events[i].Time.Sub(hist.Events[i-1].Time) < 30*time.Millisecond {
+			t.Errorf("Keystroke %d followed the previous one too quickly", i)
+		}
+	}
+	if hist.Events[2].Kind != protocol.InputKey {
+		t.Errorf("Arrow key recorded as %s", hist.Events[2].Kind)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTypeArguments(t *testing.T) {
+	// A trailing flag without its value is a usage error, checked in a
+	// child process since the client exits.
+	if args := os.Getenv("SPECTER_TYPE_ARGS"); args != "" {
+		client.Type(strings.Fields(args))
+		return
+	}
+	for _, flag := range []string{"--delay", "--jitter", "--file"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTypeArguments$")
+		cmd.Env = append(os.Environ(), "SPECTER_TYPE_ARGS=hello "+flag)
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "Missing value for "+flag) {
+			t.Errorf("Expected usage error for trailing %s, got %v: %s", flag, err, out)
+		}
+	}
+
+	startServer(t, server.Options{}, "/bin/cat")
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	dir := t.TempDir()
+	escaped := filepath.Join(dir, "escaped")
+	os.WriteFile(escaped, []byte(`a\x41`), 0o644)
+	stdin, _ := os.Create(filepath.Join(dir, "stdin"))
+	stdin.WriteString("from stdin")
+	stdin.Seek(0, 0)
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	client.Type([]string{"ls", "-la", "--file", escaped, "a", "b"})
+	client.Type([]string{"--file", escaped, `\x41`})
+	client.Type([]string{"--raw", "--file", escaped, `\n`})
+	client.Type([]string{"x", "-", "y"})
+
+	var hist protocol.HistoryResult
+	c.Call(protocol.OpHistory, nil, &hist)
+
+	// Text arguments are joined with spaces and have escapes interpreted
+	// unless --raw is given; file and stdin input is typed as it is.
+	want := []string{`ls -laa\x41a b`, `a\x41A`, `a\x41\n`, "xfrom stdiny"}
+	if len(hist.Events) != len(want) {
+		t.Fatalf("Expected %d inputs, got %+v", len(want), hist.Events)
+	}
+	for i, text := range want {
+		if string(hist.Events[i].Data) != text {
+			t.Errorf("Input %d is %q, want %q", i, hist.Events[i].Data, text)
+		}
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestExpect(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf 'Password: '; read p; printf 'Continue? [y/n] '; read a; echo "done $p $a"; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	var result protocol.ExpectResult
+	err = c.Call(protocol.OpExpect, protocol.ExpectParams{
+		Rules: []protocol.ExpectRule{
+			{On: `\[y/n\]`, Send: "y\n"},
+			{On: `Password:`, Send: "hunter2\n"},
+		},
+		Until:   `done \w+ y`,
+		Timeout: protocol.Duration(3 * time.Second),
+	}, &result)
+	if err != nil {
+		t.Fatalf("Expect failed: %v (%+v)", err, result)
+	}
+
+	if len(result.Fired) != 2 || result.Fired[0].Rule != 1 || result.Fired[1].Rule != 0 {
+		t.Errorf("Unexpected fired rules %+v", result.Fired)
+	}
+	if result.Until != "done hunter2 y" {
+		t.Errorf("Until matched %q", result.Until)
+	}
+
+	// The prompts were answered, so a second expect must not fire again.
+	err = c.Call(protocol.OpExpect, protocol.ExpectParams{
+		Rules:   []protocol.ExpectRule{{On: `Password:`, Send: "again\n"}},
+		Until:   `never`,
+		Timeout: protocol.Duration(200 * time.Millisecond),
+	}, &result)
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.ErrTimeout {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	if len(result.Fired) != 0 {
+		t.Errorf("Answered prompt fired again: %+v", result.Fired)
+	}
+
+	// The screen still shows the earlier output, which only counts when
+	// asked for.
+	err = c.Call(protocol.OpExpect, protocol.ExpectParams{
+		Until:   `done \w+`,
+		Timeout: protocol.Duration(200 * time.Millisecond),
+	}, &result)
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.ErrTimeout {
+		t.Errorf("Expected old output not to match until, got %v (%+v)", err, result)
+	}
+	err = c.Call(protocol.OpExpect, protocol.ExpectParams{
+		Until:       `done \w+`,
+		UntilScreen: true,
+		Timeout:     protocol.Duration(200 * time.Millisecond),
+	}, &result)
+	if err != nil || result.Until != "done hunter2" {
+		t.Errorf("Expected until to match the screen, got %q, %v", result.Until, err)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestCaptureRegion(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf 'alpha beta\ngamma delta\nprompt> '; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	capture := func(params protocol.CaptureParams) protocol.CaptureResult {
+		t.Helper()
+		var result protocol.CaptureResult
+		if err := c.Call(protocol.OpCapture, params, &result); err != nil {
+			t.Fatalf("Capture %+v failed: %v", params, err)
+		}
+		return result
+	}
+
+	if got := capture(protocol.CaptureParams{Region: "0,6,1,10"}).Text; got != "beta \ndelta\n" {
+		t.Errorf("Rectangle capture gave %q", got)
+	}
+	if got := capture(protocol.CaptureParams{Region: "line:1"}).Text; !strings.HasPrefix(got, "gamma delta ") || strings.Count(got, "\n") != 1 {
+		t.Errorf("Line capture gave %q", got)
+	}
+	if got := capture(protocol.CaptureParams{Region: "cursor-line"}).Text; !strings.HasPrefix(got, "prompt> ") {
+		t.Errorf("Cursor line capture gave %q", got)
+	}
+
+	screen := capture(protocol.CaptureParams{Format: "json", Region: "last-line"}).Screen
+	if screen == nil || len(screen.Lines) != 1 || screen.Region.Top != screen.Rows-1 {
+		t.Fatalf("Unexpected JSON capture %+v", screen)
+	}
+	if screen.Cursor.Row != 2 || screen.Cursor.Col != 8 {
+		t.Errorf("Unexpected cursor %+v", screen.Cursor)
+	}
+
+	var full, cropped bytes.Buffer
+	c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png"}, nil, &full)
+	c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png", Region: "0,0,1,10"}, nil, &cropped)
+	if cropped.Len() == 0 || cropped.Len() >= full.Len() {
+		t.Errorf("Cropped PNG (%d bytes) is not smaller than full PNG (%d bytes)", cropped.Len(), full.Len())
+	}
+
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Region: "5,5,2,2"}, nil); err == nil {
+		t.Error("Expected an inverted region to be rejected")
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestCaptureTextOptions(t *testing.T) {
+	long := strings.Repeat("x", 130)
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf 'one   \n\n\n\ntwo\n`+long+`\nend'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	capture := func(params protocol.CaptureParams) string {
+		t.Helper()
+		var result protocol.CaptureResult
+		if err := c.Call(protocol.OpCapture, params, &result); err != nil {
+			t.Fatalf("Capture %+v failed: %v", params, err)
+		}
+		return result.Text
+	}
+
+	trimmed := "one\n\n\n\ntwo\n" + long[:100] + "\n" + long[100:] + "\nend\n"
+	if got := capture(protocol.CaptureParams{Trim: true}); got != trimmed {
+		t.Errorf("Trimmed capture gave %q", got)
+	}
+	if got := capture(protocol.CaptureParams{Trim: true, Squeeze: true}); got != "one\n\ntwo\n"+long[:100]+"\n"+long[100:]+"\nend\n" {
+		t.Errorf("Squeezed capture gave %q", got)
+	}
+	if got := capture(protocol.CaptureParams{Trim: true, WrapJoin: true}); got != "one\n\n\n\ntwo\n"+long+"\nend\n" {
+		t.Errorf("Wrap-joined capture gave %q", got)
+	}
+	if got := capture(protocol.CaptureParams{Trim: true, Squeeze: true, Numbered: true}); !strings.HasPrefix(got, " 0| one\n 1| \n 4| two\n") {
+		t.Errorf("Numbered capture gave %q", got)
+	}
+
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json", Trim: true}, nil); err == nil {
+		t.Error("Expected --trim to be rejected for JSON captures")
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestWideCharacters(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", "printf '日本語|a\\ne\u0301|b\\n👩\u200d💻|c\\n'; sleep 2")
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Trim: true}, &result); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if want := "日本語|a\ne\u0301|b\n👩\u200d💻|c\n"; result.Text != want {
+		t.Errorf("Capture gave %q, want %q", result.Text, want)
+	}
+
+	// Each wide character spans two columns and is emitted once.
+	find := func(pattern string) protocol.Match {
+		t.Helper()
+		var found protocol.FindResult
+		if err := c.Call(protocol.OpFind, protocol.FindParams{Pattern: pattern}, &found); err != nil || len(found.Matches) != 1 {
+			t.Fatalf("Find %q gave %+v, %v", pattern, found, err)
+		}
+		return found.Matches[0]
+	}
+	if m := find("本"); m.Col != 2 || m.EndCol != 4 {
+		t.Errorf("Wide character matched at %+v", m)
+	}
+	if m := find("|a"); m.Col != 6 {
+		t.Errorf("Text after CJK matched at %+v", m)
+	}
+	if m := find("|b"); m.Col != 1 {
+		t.Errorf("Text after a combining mark matched at %+v", m)
+	}
+	if m := find("|c"); m.Col != 4 {
+		t.Errorf("Text after a ZWJ sequence matched at %+v", m)
+	}
+
+	// Regions that cut a wide character in half keep their width.
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Region: "0,1,0,4"}, &result); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if result.Text != " 本 \n" {
+		t.Errorf("Cropped capture gave %q", result.Text)
+	}
+
+	var png bytes.Buffer
+	if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png"}, nil, &png); err != nil || png.Len() == 0 {
+		t.Errorf("PNG capture failed: %v", err)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRenderAttributes(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf '\033[2mDIM\033[0m NORM\033[5 q'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if cur := result.Screen.Cursor; !cur.Visible || cur.Shape != "bar" {
+		t.Errorf("Unexpected cursor %+v", cur)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png", Region: "0,0,0,7"}, nil, &buf); err != nil {
+		t.Fatalf("PNG capture failed: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Invalid PNG: %v", err)
+	}
+
+	// Faint text is drawn in a darker color than normal text.
+	cellWidth := img.Bounds().Dx() / 8
+	brightest := func(fromCol, toCol int) uint32 {
+		var peak uint32
+		for x := fromCol * cellWidth; x < toCol*cellWidth; x++ {
+			for y := 0; y < img.Bounds().Dy(); y++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				peak = max(peak, r+g+b)
+			}
+		}
+		return peak
+	}
+	dim, normal := brightest(0, 3), brightest(4, 8)
+	if dim == 0 || dim >= normal {
+		t.Errorf("Faint text brightness %d is not below normal text brightness %d", dim, normal)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTheme(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "theme.toml")
+	os.WriteFile(file, []byte(`# A test theme
+foreground = "#eeeeee"
+background = "#102030"
+cursor = "#ff0000"
+palette = [
+  "#000000", "#aa0000", "#00aa00", "#aaaa00", "#0000aa", "#aa00aa", "#00aaaa", "#aaaaaa",
+  "#555555", "#ff5555", "#55ff55", "#ffff55", "#5555ff", "#ff55ff", "#55ffff", "#ffffff",
+]
+`), 0644)
+
+	theme, err := server.LoadTheme(file)
+	if err != nil {
+		t.Fatalf("LoadTheme failed: %v", err)
+	}
+	if theme.Palette[1] != (color.RGBA{0xaa, 0, 0, 0xff}) || theme.Background != (color.RGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("Unexpected theme %+v", theme)
+	}
+	if _, err := server.LoadTheme("no-such-theme"); err == nil {
+		t.Error("Expected an unknown theme to be rejected")
+	}
+
+	// Only colors set by ANSI index take the theme's colors: cube black
+	// (5;16) and a truecolor red that match libvterm palette entries stay,
+	// also when given with colons.
+	startServer(t, server.Options{Theme: "solarized-light"}, "/bin/sh", "-c", `printf '\033[41m \033[48;5;1m \033[48;5;16m \033[48;2;224;0;0m \033[48:2::224:0:0m \033[48:5:1m \033[0m'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png", Region: "0,0,0,7"}, nil, &buf); err != nil {
+		t.Fatalf("PNG capture failed: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Invalid PNG: %v", err)
+	}
+
+	// The red backgrounds come from the theme palette, and empty cells
+	// show the theme background. The cursor is on column 6.
+	cellWidth := img.Bounds().Dx() / 8
+	at := func(col int) color.RGBA {
+		r, g, b, _ := img.At(col*cellWidth+cellWidth/2, img.Bounds().Dy()/2).RGBA()
+		return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}
+	}
+	for col, want := range map[int]color.RGBA{
+		0: {0xdc, 0x32, 0x2f, 0xff},
+		1: {0xdc, 0x32, 0x2f, 0xff},
+		2: {0x00, 0x00, 0x00, 0xff},
+		3: {0xe0, 0x00, 0x00, 0xff},
+		4: {0xe0, 0x00, 0x00, 0xff},
+		5: {0xdc, 0x32, 0x2f, 0xff},
+		7: {0xfd, 0xf6, 0xe3, 0xff},
+	} {
+		if got := at(col); got != want {
+			t.Errorf("Cell %d drawn in %v, want %v", col, got, want)
+		}
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRenderOptions(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf 'abc \342\230\205'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	render := func(params protocol.CaptureParams) image.Image {
+		t.Helper()
+		params.Format = "png"
+		params.Region = "0,0,0,4"
+		var buf bytes.Buffer
+		if err := c.Fetch(protocol.OpCapture, params, nil, &buf); err != nil {
+			t.Fatalf("PNG capture %+v failed: %v", params, err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Invalid PNG: %v", err)
+		}
+		return img
+	}
+
+	base := render(protocol.CaptureParams{}).Bounds()
+	if padded := render(protocol.CaptureParams{Padding: 10}).Bounds(); padded.Dx() != base.Dx()+20 || padded.Dy() != base.Dy()+20 {
+		t.Errorf("Padded size %v, base size %v", padded.Size(), base.Size())
+	}
+	if scaled := render(protocol.CaptureParams{Scale: 2}).Bounds(); scaled.Dx() < 2*base.Dx()-5 || scaled.Dx() > 2*base.Dx()+5 {
+		t.Errorf("Scaled size %v, base size %v", scaled.Size(), base.Size())
+	}
+	if bigger := render(protocol.CaptureParams{FontSize: 24}).Bounds(); bigger.Dy() <= base.Dy() {
+		t.Errorf("24pt size %v, base size %v", bigger.Size(), base.Size())
+	}
+
+	// GoMono has no star; the DejaVu fallback draws it where installed.
+	const dejavu = "/usr/share/fonts/truetype/dejavu/DejaVuSansMono.ttf"
+	if _, err := os.Stat(dejavu); err == nil {
+		render(protocol.CaptureParams{Fonts: []string{dejavu}})
+		img := render(protocol.CaptureParams{})
+		cellWidth := img.Bounds().Dx() / 5
+		inked := false
+		for x := 4 * cellWidth; x < 5*cellWidth; x++ {
+			for y := 0; y < img.Bounds().Dy(); y++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r > 0x8000 {
+					inked = true
+				}
+			}
+		}
+		if !inked {
+			t.Error("Star was not drawn")
+		}
+	}
+
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "png", Fonts: []string{"/no/such/font.ttf"}}, nil); err == nil {
+		t.Error("Expected a missing font to be rejected")
+	}
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Scale: 2}, nil); err == nil {
+		t.Error("Expected --scale to be rejected for text captures")
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestGoEmulator(t *testing.T) {
+	startServer(t, server.Options{Emulator: "go"}, "/bin/sh", "-c", `printf 'hello world\033[1;7H\033[4P\033[2;1H\033(0lqk\033(B\n\033[?1049hALT\033[?1049l'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Trim: true}, &result); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if want := "hello d\n┌─┐\n"; result.Text != want {
+		t.Errorf("Capture gave %q, want %q", result.Text, want)
+	}
+
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+		t.Fatalf("JSON capture failed: %v", err)
+	}
+	if cur := result.Screen.Cursor; cur.Row != 2 || cur.Col != 0 {
+		t.Errorf("Cursor at %d,%d after leaving the alternate screen", cur.Row, cur.Col)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestGoEmulatorEditing(t *testing.T) {
+	// \033[999C moves to the last column, wherever that is.
+	cases := []struct {
+		name, script string
+		want         func(cols int) string
+	}{
+		{"scroll region", `\033[2;3r\033[1;1Htop\033[2;1Ha\r\nb\r\nc\033[4;1Hbottom`, func(int) string { return "top\nb\nc\nbottom\n" }},
+		{"insert line", `a\r\nb\r\nc\033[2;1H\033[L`, func(int) string { return "a\n\nb\nc\n" }},
+		{"delete line", `a\r\nb\r\nc\033[1;1H\033[M`, func(int) string { return "b\nc\n" }},
+		{"insert character", `abcdef\033[1;3H\033[2@`, func(int) string { return "ab  cdef\n" }},
+		{"delete character", `abcdef\033[1;2H\033[2P`, func(int) string { return "adef\n" }},
+		{"overwrite wide right half", `日本\033[1;2Hx`, func(int) string { return " x本\n" }},
+		{"overwrite wide left half", `日本\033[1;3Hx`, func(int) string { return "日x\n" }},
+		{"pending wrap", `\033[999Cxy`, func(cols int) string { return strings.Repeat(" ", cols-1) + "x\ny\n" }},
+		{"pending wrap cancelled", `\033[999Cx\rz`, func(cols int) string { return "z" + strings.Repeat(" ", cols-2) + "x\n" }},
+		{"erase scrollback", `abc\033[3J`, func(int) string { return "abc\n" }},
+		{"autowrap off", `\033[?7l\033[999Cxy`, func(cols int) string { return strings.Repeat(" ", cols-1) + "y\n" }},
+	}
+	for _, tc := range cases {
+		startServer(t, server.Options{Emulator: "go"}, "/bin/sh", "-c", `printf '`+tc.script+`'; sleep 2`)
+
+		c, err := client.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		var result protocol.CaptureResult
+		if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+			t.Fatalf("%s: JSON capture failed: %v", tc.name, err)
+		}
+		want := tc.want(result.Screen.Cols)
+		if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Trim: true}, &result); err != nil {
+			t.Fatalf("%s: capture failed: %v", tc.name, err)
+		}
+		if result.Text != want {
+			t.Errorf("%s: capture gave %q, want %q", tc.name, result.Text, want)
+		}
+
+		c.Call(protocol.OpKill, nil, nil)
+		c.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestGoEmulatorAttributes(t *testing.T) {
+	startServer(t, server.Options{Emulator: "go"}, "/bin/sh", "-c", `printf '\033[1;3;4;9;31mA\033[22;23;24;29;39mB\033[7;38;5;21mC\033[0;48;2;1;2;3mD\033[0;4:3;38:2::1:2:3mE\033[4:0;38:5:1mF\033[0m\n'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "html", Region: "0,0,0,5"}, nil, &buf); err != nil {
+		t.Fatalf("HTML capture failed: %v", err)
+	}
+	for _, want := range []string{
+		`<span style="color: #e00000; font-weight: bold; font-style: italic; text-decoration: underline line-through">A</span>B`,
+		`<span style="color: #000000; background: #0000ff">C</span>`,
+		`<span style="background: #010203">D</span>`,
+		`<span style="color: #010203; text-decoration: underline">E</span>`,
+		`<span style="color: #e00000">F</span>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("HTML capture lacks %s:\n%s", want, buf.String())
+		}
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestGoEmulatorModeReports(t *testing.T) {
+	// DECRQM answers 1 for set, 2 for reset and 0 for unknown modes.
+	answers := filepath.Join(t.TempDir(), "answers")
+	startServer(t, server.Options{Emulator: "go"}, "/bin/sh", "-c",
+		`stty raw -echo min 0 time 5; printf '\033[?2004h\033[?2004$p\033[?2026$p\033[?7$p\033[?9999$p\033[4h\033[4$p\033[20$p'; cat > `+answers+`; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(1200 * time.Millisecond)
+
+	got, _ := os.ReadFile(answers)
+	if want := "\x1b[?2004;1$y\x1b[?2026;2$y\x1b[?7;1$y\x1b[?9999;0$y\x1b[4;1$y\x1b[20;0$y"; string(got) != want {
+		t.Errorf("Answers are %q, want %q", got, want)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestTitle(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf '\033]0;first\007'; read line; printf '\033]2;build: done\033\\\033]1;icon\007'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var title protocol.TitleResult
+	if err := c.Call(protocol.OpTitle, nil, &title); err != nil {
+		t.Fatalf("Title failed: %v", err)
+	}
+	if title.Title != "first" || title.IconName != "first" {
+		t.Errorf("OSC 0 gave %+v", title)
+	}
+
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Title: "done", Timeout: protocol.Duration(300 * time.Millisecond)}, nil); err == nil {
+		t.Error("Expected wait-for to time out")
+	}
+	if err := c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
+	}
+	var waited protocol.WaitForResult
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Title: "done$", Timeout: protocol.Duration(2 * time.Second)}, &waited); err != nil {
+		t.Fatalf("Wait-for failed: %v", err)
+	}
+	if waited.Title != "build: done" {
+		t.Errorf("Wait-for returned title %q", waited.Title)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var status protocol.StatusResult
+	if err := c.Call(protocol.OpStatus, nil, &status); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.Title != "build: done" || status.IconName != "icon" || status.Exited || status.Rows != 30 || status.Pid == 0 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	var result protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+		t.Fatalf("JSON capture failed: %v", err)
+	}
+	if result.Screen.Title != "build: done" {
+		t.Errorf("JSON capture title %q", result.Screen.Title)
+	}
+
+	height := func(params protocol.CaptureParams) int {
+		t.Helper()
+		params.Format = "png"
+		var buf bytes.Buffer
+		if err := c.Fetch(protocol.OpCapture, params, nil, &buf); err != nil {
+			t.Fatalf("PNG capture failed: %v", err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Invalid PNG: %v", err)
+		}
+		return img.Bounds().Dy()
+	}
+	if plain, bar := height(protocol.CaptureParams{}), height(protocol.CaptureParams{TitleBar: true}); bar != plain+plain/30 {
+		t.Errorf("Title bar made the screenshot %d pixels high, was %d", bar, plain)
+	}
+
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{}, nil); err == nil {
+		t.Error("Expected wait-for without conditions to be rejected")
+	}
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{TitleBar: true}, nil); err == nil {
+		t.Error("Expected --title-bar to be rejected for text captures")
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestEvents(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf '\033]9;hello\007\033]9;4;1;50\007\033]777;notify;Build;done\033\\'; read line; printf '\007'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Bell: true, Timeout: protocol.Duration(300 * time.Millisecond)}, nil); err == nil {
+		t.Error("Expected wait-for --bell to time out")
+	}
+	if err := c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
+	}
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Bell: true, Timeout: protocol.Duration(2 * time.Second)}, nil); err != nil {
+		t.Fatalf("Wait-for --bell failed: %v", err)
+	}
+
+	var events protocol.EventsResult
+	if err := c.Call(protocol.OpEvents, nil, &events); err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if len(events.Events) != 3 {
+		t.Fatalf("Expected 3 events, got %+v", events.Events)
+	}
+	if ev := events.Events[0]; ev.Kind != protocol.EventNotify || ev.Body != "hello" {
+		t.Errorf("OSC 9 gave %+v", ev)
+	}
+	if ev := events.Events[1]; ev.Kind != protocol.EventNotify || ev.Title != "Build" || ev.Body != "done" {
+		t.Errorf("OSC 777 gave %+v", ev)
+	}
+	if ev := events.Events[2]; ev.Kind != protocol.EventBell || ev.Time.Before(events.Events[1].Time) {
+		t.Errorf("Bell gave %+v", ev)
+	}
+
+	var status protocol.StatusResult
+	if err := c.Call(protocol.OpStatus, nil, &status); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.Bells != 1 || status.Notifications != 2 {
+		t.Errorf("Status counted %d bells and %d notifications", status.Bells, status.Notifications)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestClipboard(t *testing.T) {
+	// The program copies, then reads back the query answer once per line.
+	startServer(t, server.Options{}, "/bin/sh", "-c", `stty -echo; printf '\033]52;c;Y29waWVk\007'; read line; printf '\033]52;c;?\007'; read -r answer; printf '%s' "$answer" | od -c | head -2; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var result protocol.ClipboardResult
+	if err := c.Call(protocol.OpClipboard, protocol.ClipboardParams{Selection: "c"}, &result); err != nil {
+		t.Fatalf("Clipboard get failed: %v", err)
+	}
+	if result.Text != "copied" {
+		t.Errorf("Clipboard holds %q after OSC 52", result.Text)
+	}
+
+	if err := c.Call(protocol.OpClipboard, protocol.ClipboardParams{Selection: "c", Set: true, Text: "hi"}, nil); err != nil {
+		t.Fatalf("Clipboard set failed: %v", err)
+	}
+	if err := c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil)
+	time.Sleep(300 * time.Millisecond)
+
+	var screen protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Trim: true}, &screen); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	// "hi" is aGk= in base64.
+	if !strings.Contains(screen.Text, "]   5   2   ;   c   ;   a   G   k   =") {
+		t.Errorf("Query was not answered from the clipboard:\n%s", screen.Text)
+	}
+
+	if err := c.Call(protocol.OpClipboard, protocol.ClipboardParams{Selection: "x"}, nil); err == nil {
+		t.Error("Expected an invalid selection to be rejected")
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestLinks(t *testing.T) {
+	for _, emulator := range []string{"", "go"} {
+		startServer(t, server.Options{Emulator: emulator}, "/bin/sh", "-c", `printf 'see \033]8;;https://example.com/a?b=1&c=2\033\\the docs\033]8;;\033\\ or \033]8;id=x;file:///tmp/日本\007日本\033]8;;\007\n\033[2Kplain \033]8;;javascript:alert(1)\033\\evil\033]8;;\033\\'; sleep 2`)
+
+		c, err := client.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		time.Sleep(300 * time.Millisecond)
+
+		var result protocol.LinksResult
+		if err := c.Call(protocol.OpLinks, nil, &result); err != nil {
+			t.Fatalf("Links failed: %v", err)
+		}
+		want := []protocol.Link{
+			{Row: 0, Col: 4, EndCol: 12, Text: "the docs", URI: "https://example.com/a?b=1&c=2"},
+			{Row: 0, Col: 16, EndCol: 20, Text: "日本", URI: "file:///tmp/日本"},
+			{Row: 1, Col: 6, EndCol: 10, Text: "evil", URI: "javascript:alert(1)"},
+		}
+		if !reflect.DeepEqual(result.Links, want) {
+			t.Errorf("%q emulator: links %+v, want %+v", emulator, result.Links, want)
+		}
+
+		var capture protocol.CaptureResult
+		if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json", Region: "0,0,0,10"}, &capture); err != nil {
+			t.Fatalf("JSON capture failed: %v", err)
+		}
+		if links := capture.Screen.Links; len(links) != 1 || links[0].Text != "the doc" {
+			t.Errorf("%q emulator: region links %+v", emulator, links)
+		}
+
+		for _, format := range []string{"html", "svg"} {
+			var buf bytes.Buffer
+			if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: format}, nil, &buf); err != nil {
+				t.Fatalf("%s capture failed: %v", format, err)
+			}
+			if !strings.Contains(buf.String(), `<a href="https://example.com/a?b=1&amp;c=2"`) || !strings.Contains(buf.String(), "the docs</") {
+				t.Errorf("%s capture has no anchor:\n%s", format, buf.String())
+			}
+			// Links with other schemes are drawn as plain text.
+			if strings.Contains(buf.String(), "javascript:") || !strings.Contains(buf.String(), "evil<") {
+				t.Errorf("%s capture links an unsafe URI:\n%s", format, buf.String())
+			}
+		}
+
+		c.Call(protocol.OpKill, nil, nil)
+		c.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestModes(t *testing.T) {
+	startServer(t, server.Options{}, "/bin/sh", "-c", `printf '\033[?1049h\033[?1h\033=\033[?1002h\033[?1006h\033[?2004h\033[?1004h\033[?25l'; read line; printf '\033[?1049l\033[?1l\033>\033[?1002l\033[?25h'; read line; printf '\033[?1049h\033[!p'; sleep 2`)
+
+	c, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	var modes protocol.Modes
+	if err := c.Call(protocol.OpModes, nil, &modes); err != nil {
+		t.Fatalf("Modes failed: %v", err)
+	}
+	want := protocol.Modes{
+		AltScreen:      true,
+		AppCursor:      true,
+		AppKeypad:      true,
+		BracketedPaste: true,
+		Focus:          true,
+		Autowrap:       true,
+		Mouse:          "button-event",
+		MouseEncoding:  "sgr",
+	}
+	if modes != want {
+		t.Errorf("Modes %+v, want %+v", modes, want)
+	}
+
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Modes: []string{"altscreen=off"}, Timeout: protocol.Duration(300 * time.Millisecond)}, nil); err == nil {
+		t.Error("Expected wait-for --mode altscreen=off to time out")
+	}
+	if err := c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil); err != nil {
+		t.Fatalf("Type failed: %v", err)
+	}
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Modes: []string{"altscreen=off", "mouse=off", "cursor_visible=on"}, Timeout: protocol.Duration(2 * time.Second)}, nil); err != nil {
+		t.Fatalf("Wait-for teardown failed: %v", err)
+	}
+
+	var result protocol.CaptureResult
+	if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+		t.Fatalf("JSON capture failed: %v", err)
+	}
+	if m := result.Screen.Modes; m.AltScreen || m.AppCursor || m.AppKeypad || !m.BracketedPaste || !m.Focus {
+		t.Errorf("Modes after teardown %+v", m)
+	}
+
+	for _, cond := range []string{"nosuchmode=on", "altscreen", "altscreen=of", "mouse=bogus", "mouse_encoding=on"} {
+		start := time.Now()
+		if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Modes: []string{cond}}, nil); err == nil || time.Since(start) > time.Second {
+			t.Errorf("Expected mode condition %q to be rejected at once", cond)
+		}
+	}
+
+	// A soft reset (DECSTR) clears modes but stays on the alternate screen.
+	c.Call(protocol.OpType, protocol.TypeParams{Text: "\n"}, nil)
+	if err := c.Call(protocol.OpWaitFor, protocol.WaitForParams{Modes: []string{"bracketed_paste=off", "altscreen=on"}, Timeout: protocol.Duration(2 * time.Second)}, nil); err != nil {
+		t.Errorf("Wait-for after DECSTR failed: %v", err)
+	}
+
+	c.Call(protocol.OpKill, nil, nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestQueries(t *testing.T) {
+	cases := []struct {
+		emulator, identity      string
+		term, version, da1, da2 string
+	}{
+		{"", "", "xterm-256color", "XTerm(390)", "64;1;2;6;9;15;16;17;18;21;22;28", "41;390;0"},
+		{"go", "kitty", "xterm-kitty", "kitty(0.35.2)", "62;", "1;4000;35"},
+		{"", "tmux", "tmux-256color", "tmux 3.4", "1;2", "84;0;0"},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		answers := filepath.Join(dir, "answers")
+		// The program asks in raw mode and saves whatever arrives within
+		// half a second; DA1 goes last, as programs use it as a sentinel.
+		startServer(t, server.Options{Emulator: tc.emulator, Identity: tc.identity}, "/bin/sh", "-c",
+			`printf '%s' "$TERM" > `+answers+`.term; stty raw -echo min 0 time 5; printf '\033]11;?\033\\\033[>q\033P+q544e;5a5a\033\\\033[>c\033[6n\033[c'; cat > `+answers+`; sleep 2`)
+
+		time.Sleep(1200 * time.Millisecond)
+
+		term, _ := os.ReadFile(answers + ".term")
+		if string(term) != tc.term {
+			t.Errorf("%s: TERM is %q, want %q", tc.identity, term, tc.term)
+		}
+		got, err := os.ReadFile(answers)
+		if err != nil {
+			t.Fatalf("Reading answers failed: %v", err)
+		}
+		want := "\x1b]11;rgb:0000/0000/0000\x1b\\" +
+			"\x1bP>|" + tc.version + "\x1b\\" +
+			"\x1bP1+r544e=" + strings.ToUpper(hex.EncodeToString([]byte(tc.term))) + "\x1b\\\x1bP0+r\x1b\\" +
+			"\x1b[>" + tc.da2 + "c" +
+			"\x1b[1;1R" +
+			"\x1b[?" + tc.da1 + "c"
+		if string(got) != want {
+			t.Errorf("%s: answers are %q, want %q", tc.identity, got, want)
+		}
+
+		c, err := client.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		c.Call(protocol.OpKill, nil, nil)
+		c.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestGraphics(t *testing.T) {
+	// A 20x40 red kitty image covers 2x2 cells; a 10x6 blue sixel covers one.
+	red := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{255, 0, 0}, 20*40))
+	// File transmission and PNGs over the size limit are refused.
+	passwd := base64.StdEncoding.EncodeToString([]byte("/etc/passwd"))
+	var tall bytes.Buffer
+	png.Encode(&tall, image.NewGray(image.Rect(0, 0, 1, 10001)))
+	tallPNG := base64.StdEncoding.EncodeToString(tall.Bytes())
+	for _, emulator := range []string{"", "go"} {
+		answers := filepath.Join(t.TempDir(), "answers")
+		startServer(t, server.Options{Emulator: emulator}, "/bin/sh", "-c",
+			`stty raw -echo min 0 time 5; printf 'ab\033_Gi=31,s=1,v=1,a=q,f=24;AAAA\033\\\033_Gi=32,a=q,t=f;`+passwd+`\033\\\033_Gi=33,a=q,f=100;`+tallPNG+`\033\\\033_Ga=T,i=7,f=24,s=20,v=40;`+red+`\033\\cd\r\n\033Pq#1;2;0;0;100#1!10~\033\\ef\033[c'; cat > `+answers+`; stty min 1 time 0; dd bs=1 count=1 >/dev/null 2>&1; printf '\n%.0s' $(seq 27); sleep 2`)
+
+		c, err := client.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		time.Sleep(1200 * time.Millisecond)
+
+		got, _ := os.ReadFile(answers)
+		if want := "\x1b_Gi=31;OK\x1b\\\x1b_Gi=32;EINVAL:Transmission medium \"f\" is not supported\x1b\\\x1b_Gi=33;EINVAL:Invalid image size 1x10001\x1b\\\x1b_Gi=7;OK\x1b\\\x1b[?64;1;2;6;9;15;16;17;18;21;22;28c"; string(got) != want {
+			t.Errorf("%s: answers are %q, want %q", emulator, got, want)
+		}
+
+		var result protocol.CaptureResult
+		if err := c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result); err != nil {
+			t.Fatalf("Capture failed: %v", err)
+		}
+		want := []protocol.Image{
+			{Protocol: "kitty", ID: 7, Row: 0, Col: 2, Rows: 2, Cols: 2, Width: 20, Height: 40},
+			{Protocol: "sixel", Row: 2, Col: 0, Rows: 1, Cols: 1, Width: 10, Height: 6},
+		}
+		if !reflect.DeepEqual(result.Screen.Images, want) {
+			t.Errorf("%s: images are %+v, want %+v", emulator, result.Screen.Images, want)
+		}
+		// The cursor moves past each image, as in kitty and xterm.
+		if lines := result.Screen.Lines; strings.TrimRight(lines[1], " ") != "    cd" || strings.TrimRight(lines[3], " ") != "ef" {
+			t.Errorf("%s: text around images is %q", emulator, lines[:4])
+		}
+
+		var buf bytes.Buffer
+		if err := c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "png"}, nil, &buf); err != nil {
+			t.Fatalf("Capture PNG failed: %v", err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Decoding PNG failed: %v", err)
+		}
+		cw, ch := img.Bounds().Dx()/result.Screen.Cols, img.Bounds().Dy()/result.Screen.Rows
+		if r, g, b, _ := img.At(cw*5/2, ch).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+			t.Errorf("%s: kitty image not drawn, got %d,%d,%d", emulator, r>>8, g>>8, b>>8)
+		}
+		if r, g, b, _ := img.At(cw/2, ch*2+1).RGBA(); r != 0 || g != 0 || b>>8 != 255 {
+			t.Errorf("%s: sixel image not drawn, got %d,%d,%d", emulator, r>>8, g>>8, b>>8)
+		}
+
+		var html bytes.Buffer
+		c.Fetch(protocol.OpCapture, protocol.CaptureParams{Format: "html"}, nil, &html)
+		if n := strings.Count(html.String(), `<img src="data:image/png;base64,`); n != 2 {
+			t.Errorf("%s: HTML capture has %d images", emulator, n)
+		}
+
+		// Scrolling by one line moves the images up with the text.
+		c.Call(protocol.OpType, protocol.TypeParams{Text: "x"}, nil)
+		time.Sleep(300 * time.Millisecond)
+		c.Call(protocol.OpCapture, protocol.CaptureParams{Format: "json"}, &result)
+		if images := result.Screen.Images; len(images) != 2 || images[0].Row != -1 || images[1].Row != 1 {
+			t.Errorf("%s: images after scrolling are %+v", emulator, images)
+		}
+
+		c.Call(protocol.OpKill, nil, nil)
+		c.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+}